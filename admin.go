@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionInfo is how /admin/sessions describes a running session.
+type sessionInfo struct {
+	ID            string `json:"id"`
+	ClientIP      string `json:"client_ip"`
+	ServerName    string `json:"server_name,omitempty"`
+	Route         string `json:"route"`
+	Target        string `json:"target"`
+	Started       string `json:"started"`
+	LastActivity  string `json:"last_activity"`
+	ToClientBytes int64  `json:"to_client_bytes"`
+	ToTargetBytes int64  `json:"to_target_bytes"`
+}
+
+// listSessionsHandler serves GET /admin/sessions: every running session,
+// oldest first.
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	list := []sessionInfo{}
+	for _, s := range sessions.list() {
+		list = append(list, sessionInfo{
+			ID:            s.id,
+			ClientIP:      s.clientIP,
+			ServerName:    s.serverName,
+			Route:         s.route,
+			Target:        s.targetAddr(),
+			Started:       s.started.Format(time.RFC3339),
+			LastActivity:  time.Unix(0, s.conn.lastActivity.Load()).Format(time.RFC3339),
+			ToClientBytes: s.toClientBytes.Load(),
+			ToTargetBytes: s.toTargetBytes.Load(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(list)
+}
+
+// deleteSessionHandler serves DELETE /admin/sessions/{id}, terminating the
+// session with a 1008 close frame.
+func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	s := sessions.get(r.PathValue("id"))
+	if s == nil {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	logger.Printf("Session %s from %s terminated by %s through the admin API", s.id, s.clientIP, clientIP(r))
+	s.terminate(websocket.ClosePolicyViolation, "terminated by administrator")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// credentials are a user:pass pair checked with HTTP basic auth.
+type credentials struct {
+	user, pass string
+}
+
+// parseCredentials parses a USER:PASS flag value.
+func parseCredentials(v string) (credentials, error) {
+	user, pass, ok := strings.Cut(v, ":")
+	if !ok || user == "" || pass == "" {
+		return credentials{}, errors.New("expected USER:PASS")
+	}
+	return credentials{user: user, pass: pass}, nil
+}
+
+// match compares in constant time so the response time doesn't leak how
+// much of the credentials was right.
+func (c credentials) match(user, pass string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.user))
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(c.pass))
+	return userOK&passOK == 1
+}
+
+// requireAuth wraps h so it is only served to clients presenting creds.
+func requireAuth(creds credentials, realm string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !creds.match(user, pass) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
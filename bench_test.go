@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// benchMessageSize is the payload each benchmark iteration sends through
+// the proxy and reads back.
+const benchMessageSize = 64 << 10
+
+// startEchoTarget listens on a loopback port and echoes every connection
+// back to itself, standing in for a VNC server.
+func startEchoTarget(tb testing.TB) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// benchPayload looks like framebuffer data: long runs of a few values, so
+// compression has something to work with.
+func benchPayload() []byte {
+	p := make([]byte, benchMessageSize)
+	for i := range p {
+		p[i] = byte(i / 97 % 7)
+	}
+	return p
+}
+
+// BenchmarkProxyEcho measures round trips of a 64 KiB message from a real
+// WebSocket client through the proxy to a loopback TCP echo target and
+// back, across -tcp-read-buffer/-ws-buffer-size values and with and
+// without -compression. Run it with
+//
+//	go test -run '^$' -bench ProxyEcho -benchmem
+//
+// MB/s counts the payload once per round trip.
+func BenchmarkProxyEcho(b *testing.B) {
+	for _, size := range []int{1024, 4096, 16384, 65536} {
+		for _, compress := range []bool{false, true} {
+			name := fmt.Sprintf("buffer=%d/compression=%v", size, compress)
+			b.Run(name, func(b *testing.B) {
+				benchmarkProxyEcho(b, size, compress)
+			})
+		}
+	}
+}
+
+func benchmarkProxyEcho(b *testing.B, size int, compress bool) {
+	setupTest(b)
+	config.tcpReadBuffer = size
+	config.wsBufferSize = size
+	config.compression = compress
+	config.resolver = staticResolver(startEchoTarget(b))
+	srv := startProxy(b)
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = compress
+	dialer.ReadBufferSize, dialer.WriteBufferSize = size, size
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	payload := benchPayload()
+	b.SetBytes(benchMessageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+			b.Fatal(err)
+		}
+		// The echo comes back cut into -tcp-read-buffer sized messages
+		for got := 0; got < benchMessageSize; {
+			_, msg, err := client.ReadMessage()
+			if err != nil {
+				b.Fatal(err)
+			}
+			got += len(msg)
+		}
+	}
+	b.StopTimer()
+}
+
+// BenchmarkCopyLoops measures each direction of a session on its own:
+// tcp-to-ws reads target data into the pooled -tcp-read-buffer and sends
+// it to the client, ws-to-tcp reads client messages into the reused
+// message buffer and writes them to the target. An iteration is one
+// -tcp-read-buffer sized message; allocs/op counts the client side too.
+func BenchmarkCopyLoops(b *testing.B) {
+	chunk := make([]byte, 1024)
+	b.Run("tcp-to-ws", func(b *testing.B) {
+		setupTest(b)
+		pipeTarget(b, func(target net.Conn) {
+			for {
+				if _, err := target.Write(chunk); err != nil {
+					return
+				}
+			}
+		})
+		client, _, err := dialProxy(b, startProxy(b))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(chunk)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, r, err := client.NextReader()
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(io.Discard, r)
+		}
+		b.StopTimer()
+	})
+	b.Run("ws-to-tcp", func(b *testing.B) {
+		setupTest(b)
+		received := make(chan int64, 1)
+		want := int64(b.N) * int64(len(chunk))
+		pipeTarget(b, func(target net.Conn) {
+			n, _ := io.CopyN(io.Discard, target, want)
+			received <- n
+			io.Copy(io.Discard, target)
+		})
+		client, _, err := dialProxy(b, startProxy(b))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(chunk)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := client.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if n := <-received; n != want {
+			b.Fatalf("target received %d bytes, want %d", n, want)
+		}
+		b.StopTimer()
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned when every target's circuit breaker is open.
+var errBreakerOpen = errors.New("circuit breaker open for every target")
+
+// breakerState is the circuit breaker of one target. It is closed while
+// openUntil is zero, open until openUntil, and half-open after that, when a
+// single dial is let through to probe the target.
+type breakerState struct {
+	failures     int       // consecutive dial failures
+	firstFailure time.Time // when the current run of failures started
+	openUntil    time.Time
+	probing      bool // a half-open probe dial is in progress
+}
+
+// breakerSet keeps a circuit breaker per target for -breaker-failures:
+// after that many consecutive dial failures within -breaker-window, new
+// connections to the target are refused without dialing for
+// -breaker-cooldown. Targets that have not failed have no entry.
+type breakerSet struct {
+	mu      sync.Mutex
+	targets map[string]*breakerState
+}
+
+var breakers = breakerSet{targets: make(map[string]*breakerState)}
+
+// allow reports whether target may be dialed. Once the cooldown of an open
+// breaker has passed, it lets one caller through to probe, which must
+// report the outcome with done.
+func (b *breakerSet) allow(target string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.targets[target]
+	if s == nil || s.openUntil.IsZero() {
+		return true
+	}
+	if s.probing || time.Now().Before(s.openUntil) {
+		return false
+	}
+	verboseLogger.Printf("Circuit breaker for %s is half-open, probing the target", target)
+	s.probing = true
+	return true
+}
+
+// done records the outcome of a dial to target. A dial abandoned because
+// the client went away says nothing about the target and is not counted.
+func (b *breakerSet) done(target string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.targets[target]
+	switch {
+	case err == nil:
+		if s != nil && !s.openUntil.IsZero() {
+			logger.Printf("Circuit breaker for %s closed: the target is reachable again", target)
+		}
+		delete(b.targets, target)
+		return
+	case errors.Is(err, context.Canceled):
+		if s != nil {
+			s.probing = false
+		}
+		return
+	}
+	now := time.Now()
+	if s == nil {
+		s = &breakerState{}
+		b.targets[target] = s
+	}
+	if s.probing || !s.openUntil.IsZero() {
+		if s.probing {
+			logger.Printf("Circuit breaker for %s reopened: probe failed: %v", target, err)
+		}
+		s.probing = false
+		s.openUntil = now.Add(config.breakerCooldown)
+		return
+	}
+	if s.failures == 0 || now.Sub(s.firstFailure) > config.breakerWindow {
+		s.failures, s.firstFailure = 0, now
+	}
+	s.failures++
+	if s.failures >= config.breakerFailures {
+		logger.Printf("Circuit breaker for %s opened after %d consecutive dial failures; refusing connections to it for %v",
+			target, s.failures, config.breakerCooldown)
+		s.openUntil = now.Add(config.breakerCooldown)
+	}
+}
+
+// isOpen reports whether target's breaker is open or busy probing.
+func (b *breakerSet) isOpen(target string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.targets[target]
+	return s != nil && !s.openUntil.IsZero() && (s.probing || time.Now().Before(s.openUntil))
+}
+
+// allOpen reports whether the breaker of every one of targets is open, and
+// if so how many seconds until the first of them goes half-open.
+func (b *breakerSet) allOpen(targets []string) (bool, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for i, target := range targets {
+		s := b.targets[target]
+		if s == nil || s.openUntil.IsZero() || (!s.probing && !now.Before(s.openUntil)) {
+			return false, 0
+		}
+		if d := s.openUntil.Sub(now); i == 0 || d < wait {
+			wait = d
+		}
+	}
+	return len(targets) > 0, max(1, int((wait+time.Second-1)/time.Second))
+}
+
+// sweep drops closed breakers whose failures are older than the window.
+func (b *breakerSet) sweep() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for target, s := range b.targets {
+		if s.openUntil.IsZero() && now.Sub(s.firstFailure) > config.breakerWindow {
+			delete(b.targets, target)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// tcpBufferPool holds the -tcp-read-buffer sized buffers the TCP to
+// WebSocket loops read into, so a burst of short sessions doesn't allocate
+// a fresh buffer each.
+var tcpBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, config.tcpReadBuffer)
+		return &buf
+	},
+}
+
+// wsWriteBufferPool lets idle WebSocket connections give their write
+// buffers back between messages instead of each holding one for its
+// lifetime.
+var wsWriteBufferPool sync.Pool
+
+// writeBufferSize returns the WebSocket write buffer size: -max-frame-size
+// when set, since Gorilla cuts fragmented messages into frames the size of
+// the buffer, and -ws-buffer-size otherwise.
+func writeBufferSize() int {
+	if config.maxFrameSize > 0 {
+		return config.maxFrameSize
+	}
+	return config.wsBufferSize
+}
+
+// clientTooSlow reports whether sending pending more bytes would put the
+// client more than -max-buffer-bytes behind, counting what the kernel still
+// buffers for it, and if so closes the session. Without this, a fast target
+// and a slow client can only be told apart once the socket buffers are full.
+// It is checked before each write, because a write to a full send buffer
+// blocks until the client reads; for the same reason the kernel never holds
+// more than the socket send buffer, so a limit above that never triggers.
+func clientTooSlow(sess *session, pending int) bool {
+	n, err := unsentBytes(sess.conn.UnderlyingConn())
+	if err != nil || n+pending <= config.maxBufferBytes {
+		return false
+	}
+	logger.Printf("Session %s: client too slow (%d bytes unacknowledged), closing", sess.id, n)
+	sess.setCloseCause(causeProxy)
+	sess.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow"),
+		time.Now().Add(time.Second))
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// checkAddr reports whether addr is a well-formed host:port.
+func checkAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateConfig checks the parsed configuration for errors that would
+// otherwise only surface once the server is running.
+func validateConfig(listenAddr, certFile, keyFile, webDir string) error {
+	if !socketActivated() {
+		if err := checkAddr(listenAddr); err != nil {
+			return fmt.Errorf("invalid listen address: %w", err)
+		}
+	}
+	if config.targetAddr != "" {
+		if err := checkAddr(config.targetAddr); err != nil {
+			return fmt.Errorf("invalid target address: %w", err)
+		}
+	}
+	if config.fallbackTarget != "" {
+		if err := checkAddr(config.fallbackTarget); err != nil {
+			return fmt.Errorf("invalid -fallback-target: %w", err)
+		}
+	}
+	if config.targetWS != "" {
+		u, err := url.Parse(config.targetWS)
+		if err != nil {
+			return fmt.Errorf("invalid -target-ws: %w", err)
+		}
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return fmt.Errorf("invalid -target-ws %s: scheme must be ws or wss", redactURL(config.targetWS))
+		}
+	}
+	for _, rt := range config.routes {
+		if err := checkAddr(rt.target); err != nil {
+			return fmt.Errorf("invalid target for route %s: %w", rt.path, err)
+		}
+	}
+	if config.recordDir != "" {
+		fi, err := os.Stat(config.recordDir)
+		if err != nil {
+			return fmt.Errorf("invalid -record directory: %w", err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("invalid -record directory: %s is not a directory", config.recordDir)
+		}
+	}
+	if webDir != "" {
+		fi, err := os.Stat(webDir)
+		if err != nil {
+			return fmt.Errorf("invalid -web directory: %w", err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("invalid -web directory: %s is not a directory", webDir)
+		}
+	}
+	// Never fall back to plaintext when TLS was asked for
+	if tlsRequested(certFile, keyFile) {
+		cert, err := loadCertificate(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load TLS certificate, refusing to serve plaintext: %w", err)
+		}
+		if config.ocspStaple != "" {
+			der, err := os.ReadFile(config.ocspStaple)
+			if err != nil {
+				return fmt.Errorf("invalid -ocsp-staple: %w", err)
+			}
+			if _, err := checkOCSPResponse(der, cert.Leaf.SerialNumber, time.Now()); err != nil {
+				return fmt.Errorf("invalid -ocsp-staple: %w", err)
+			}
+		}
+	} else if config.ocspStaple != "" {
+		return fmt.Errorf("-ocsp-staple requires TLS")
+	}
+	if config.clientCAFile != "" {
+		if !tlsRequested(certFile, keyFile) {
+			return fmt.Errorf("-client-ca requires TLS")
+		}
+		if _, err := loadClientCAs(config.clientCAFile); err != nil {
+			return fmt.Errorf("invalid -client-ca: %w", err)
+		}
+	}
+	if config.clientCRL != "" {
+		if config.clientCAFile == "" {
+			return fmt.Errorf("-client-crl requires -client-ca")
+		}
+		if _, err := loadCRLs(config.clientCRL); err != nil {
+			return fmt.Errorf("invalid -client-crl: %w", err)
+		}
+	}
+	return nil
+}
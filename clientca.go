@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// tlsFilePollInterval is how often the -client-ca and -client-crl files are
+// checked for changes.
+const tlsFilePollInterval = 30 * time.Second
+
+// watchFile calls load now, failing if it fails, and then again whenever
+// file's modification time or size changes, checking every
+// tlsFilePollInterval. A failed reload is logged and leaves what load set
+// before in place; it is retried on the next check. what names the file in
+// the log.
+func watchFile(file, what string, load func() error) error {
+	// Stat first: a change racing the load is then seen on the next check
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(tlsFilePollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cur, err := os.Stat(file)
+			if err != nil {
+				logger.Printf("Cannot check %s, keeping the current one: %v", what, err)
+				continue
+			}
+			if cur.ModTime().Equal(fi.ModTime()) && cur.Size() == fi.Size() {
+				continue
+			}
+			if err := load(); err != nil {
+				logger.Printf("Cannot reload %s, keeping the current one: %v", what, err)
+				continue
+			}
+			fi = cur
+			logger.Printf("Reloaded %s %s", what, file)
+		}
+	}()
+	return nil
+}
+
+// clientCAWatcher keeps the -client-ca pool current, reloading the bundle
+// when the file changes. Handshakes started after a reload verify against
+// the new pool; established connections are not affected.
+type clientCAWatcher struct {
+	pool atomic.Pointer[x509.CertPool]
+}
+
+// newClientCAWatcher loads the bundle in file, failing if it can't be used,
+// and reloads it whenever it changes.
+func newClientCAWatcher(file string) (*clientCAWatcher, error) {
+	w := &clientCAWatcher{}
+	err := watchFile(file, "client CA bundle", func() error {
+		pool, err := loadClientCAs(file)
+		if err != nil {
+			return err
+		}
+		w.pool.Store(pool)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// configForClient returns a tls.Config.GetConfigForClient hook that serves
+// each handshake a copy of base trusting the current pool.
+func (w *clientCAWatcher) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientCAs = w.pool.Load()
+		return c, nil
+	}
+}
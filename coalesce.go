@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// readCoalesced reads from conn into buf and, with -coalesce, keeps reading
+// for up to that long after the first bytes arrive so several small writes
+// from the target leave as one WebSocket message. It returns as soon as buf
+// is full. An error is only returned if no bytes were read; otherwise the
+// next call reports it.
+func readCoalesced(conn net.Conn, buf []byte) (int, error) {
+	n, err := conn.Read(buf)
+	if err != nil || config.coalesce <= 0 || n == len(buf) {
+		return n, err
+	}
+	conn.SetReadDeadline(time.Now().Add(config.coalesce))
+	defer conn.SetReadDeadline(time.Time{})
+	for n < len(buf) {
+		var m int
+		m, err = conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			break
+		}
+	}
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		// Hand the bytes over now and let the next read hit the error again
+		verboseLogger.Printf("Read error while coalescing: %v", err)
+	}
+	return n, nil
+}
+
+// setNoDelay applies -tcp-nodelay to a freshly dialed target connection.
+func setNoDelay(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(config.tcpNoDelay)
+	}
+}
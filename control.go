@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// controlCommand is a JSON command sent by the client as a text message when
+// -control-channel is on.
+type controlCommand struct {
+	Cmd string `json:"cmd"`
+}
+
+// maxControlMessage bounds the size of a control message.
+const maxControlMessage = 4096
+
+// controlResult tells the WebSocket to TCP loop how to go on after a
+// control command.
+type controlResult int
+
+const (
+	// controlContinue keeps forwarding client data.
+	controlContinue controlResult = iota
+	// controlStop ends the loop and with it the session.
+	controlStop
+	// controlWriteClosed keeps reading from the client but drops its data,
+	// since the target's write side has been closed.
+	controlWriteClosed
+)
+
+// handleControl runs the control command read from r and reports how the
+// WebSocket to TCP loop should go on.
+//
+// "disconnect" ends the session cleanly: with -half-close only the target's
+// write side is closed, so the target can finish sending and its EOF closes
+// the WebSocket as usual; otherwise the target connection is closed and the
+// client gets a normal close frame at once.
+func handleControl(sess *session, tcpConn net.Conn, closeTarget func(), r io.Reader) controlResult {
+	conn, sessionID := sess.conn, sess.id
+	var cmd controlCommand
+	if err := json.NewDecoder(io.LimitReader(r, maxControlMessage)).Decode(&cmd); err != nil {
+		logger.Printf("Session %s: invalid control message: %v", sessionID, err)
+		return controlContinue
+	}
+	switch cmd.Cmd {
+	case "disconnect":
+		verboseLogger.Printf("Session %s: client requested disconnect", sessionID)
+		sess.setCloseCause(causeClient)
+		if tc, ok := tcpConn.(*net.TCPConn); ok && config.halfClose {
+			tc.CloseWrite()
+			return controlWriteClosed
+		}
+		// Send the close frame before closing the target, whose read
+		// error would otherwise tear down the WebSocket first.
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "disconnect requested"),
+			time.Now().Add(time.Second))
+		closeTarget()
+		return controlStop
+	default:
+		logger.Printf("Session %s: unknown control command %q", sessionID, cmd.Cmd)
+		return controlContinue
+	}
+}
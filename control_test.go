@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestHalfCloseDisconnect sends a disconnect command with -half-close and
+// checks that later client data is dropped rather than written to the
+// target's closed write side, while the target can still finish sending.
+func TestHalfCloseDisconnect(t *testing.T) {
+	out := setupTest(t)
+	config.controlChannel = true
+	config.halfClose = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	config.resolver = staticResolver(ln.Addr().String())
+	client, _, err := dialProxy(t, startProxy(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	client.WriteMessage(websocket.TextMessage, []byte(`{"cmd":"disconnect"}`))
+	client.WriteMessage(websocket.BinaryMessage, []byte("late"))
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(target); err != nil || len(got) != 0 {
+		t.Fatalf("target read %q, %v; want EOF and no data", got, err)
+	}
+
+	// The target finishes sending, then hangs up
+	target.Write([]byte("bye"))
+	target.Close()
+	if _, msg, err := client.ReadMessage(); err != nil || string(msg) != "bye" {
+		t.Fatalf("ReadMessage = %q, %v; want bye", msg, err)
+	}
+	if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("client read ended with %v, want a 1000 close", err)
+	}
+	client.Close()
+	waitFor(t, "the session to end", func() bool { return sessions.count() == 0 })
+	if log := out.String(); strings.Contains(log, "TCP write error") {
+		t.Errorf("client data was written after the disconnect:\n%s", log)
+	}
+}
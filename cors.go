@@ -0,0 +1,27 @@
+package main
+
+import "net/http"
+
+// corsPreflight answers CORS preflight OPTIONS requests for every path
+// before they reach h. Any origin the upgrader would accept is reflected.
+func corsPreflight(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			origin = "*"
+		}
+		header := w.Header()
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+		header.Set("Access-Control-Max-Age", "600")
+		header.Add("Vary", "Origin")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
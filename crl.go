@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// crlChecker rejects client certificates revoked by a CRL in the
+// -client-crl file, which is reloaded when it changes.
+type crlChecker struct {
+	crls atomic.Pointer[[]*x509.RevocationList]
+}
+
+// newCRLChecker loads the CRLs in file, failing if it can't be used, and
+// reloads them whenever it changes.
+func newCRLChecker(file string) (*crlChecker, error) {
+	c := &crlChecker{}
+	err := watchFile(file, "client CRL", func() error {
+		crls, err := loadCRLs(file)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, crl := range crls {
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				logger.Printf("WARNING: the client CRL of %s expired at %v; still using it", crl.Issuer, crl.NextUpdate)
+			}
+		}
+		c.crls.Store(&crls)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadCRLs reads file, which holds one DER CRL or any number of PEM ones,
+// such as one per client CA.
+func loadCRLs(file string) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errors.New("no CRLs in " + file)
+	}
+	return crls, nil
+}
+
+// verifyConnection is a tls.Config.VerifyConnection hook. It runs after the
+// chain has been verified against -client-ca, on resumed sessions too so a
+// session ticket issued before the revocation doesn't outlive it, and fails
+// the handshake, which sends the client a bad_certificate alert, if a CRL
+// signed by the certificate's issuer lists it. Certificates whose issuer
+// has no CRL in the file are accepted.
+func (c *crlChecker) verifyConnection(cs tls.ConnectionState) error {
+	crls := *c.crls.Load()
+	for _, chain := range cs.VerifiedChains {
+		if len(chain) < 2 {
+			continue
+		}
+		leaf, issuer := chain[0], chain[1]
+		for _, crl := range crls {
+			if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+					logger.Printf("Rejecting client certificate %q (serial %s): revoked on %v",
+						leaf.Subject.CommonName, leaf.SerialNumber, entry.RevocationTime)
+					return errors.New("client certificate is revoked")
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// errConnectBudget is returned once -connect-budget has run out.
+var errConnectBudget = errors.New("connect budget exhausted")
+
+// withConnectBudget bounds ctx by -connect-budget, if set.
+func withConnectBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	if config.connectBudget <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, config.connectBudget, errConnectBudget)
+}
+
+// errTargetsFull is returned when every target is at -max-per-target.
+var errTargetsFull = errors.New("every target is at its connection limit")
+
+// dialFailureReason is the close reason sent to a client whose target
+// couldn't be connected because of err.
+func dialFailureReason(err error) string {
+	switch {
+	case errors.Is(err, errConnectBudget):
+		return "connect timeout"
+	case errors.Is(err, errTargetsFull):
+		return "backends at capacity"
+	case errors.Is(err, errBreakerOpen):
+		return "backends failing"
+	}
+	return "no backend available"
+}
+
+// withFallback returns the targets of a request on routeName with
+// -fallback-target appended, which is every target dialTarget may try. The
+// fallback stands in for the default target only: a -route's backend is a
+// different machine, so its requests don't fall back to it.
+func withFallback(targets []string, routeName string) []string {
+	if config.fallbackTarget != "" && routeName == defaultRouteName {
+		return append(targets[:len(targets):len(targets)], config.fallbackTarget)
+	}
+	return targets
+}
+
+// targetsFull reports whether every target dialTarget would try is at
+// -max-per-target, so the request can be refused before the upgrade.
+func targetsFull(targets []string, routeName string) bool {
+	return config.maxPerTarget > 0 && targetConns.allFull(withFallback(targets, routeName), config.maxPerTarget)
+}
+
+// breakersOpen reports whether the circuit breaker of every target
+// dialTarget would try is open, and if so in how many seconds to retry.
+func breakersOpen(targets []string, routeName string) (bool, int) {
+	if config.breakerFailures == 0 {
+		return false, 0
+	}
+	return breakers.allOpen(withFallback(targets, routeName))
+}
+
+// releaseTarget counts a connection to target, as returned by dialTarget,
+// as closed.
+func releaseTarget(target string) {
+	if config.maxPerTarget > 0 {
+		targetConns.release(target)
+	}
+}
+
+// dialTarget connects to the first reachable of targets, falling back to
+// -fallback-target when none is. It returns the address actually connected
+// to. Failed attempts are counted under routeName. All attempts together
+// get -connect-budget; once it runs out the remaining targets are skipped
+// and the error wraps errConnectBudget. Targets at -max-per-target are
+// skipped too, and the connection returned counts against its target's
+// limit until releaseTarget. So are targets whose circuit breaker is open,
+// and every dial feeds the breaker of its target.
+func dialTarget(ctx context.Context, targets []string, routeName string) (net.Conn, string, error) {
+	targets = withFallback(targets, routeName)
+	if len(targets) == 0 {
+		return nil, "", errors.New("no target")
+	}
+	ctx, cancel := withConnectBudget(ctx)
+	defer cancel()
+	err := errTargetsFull
+	for i, target := range targets {
+		if config.maxPerTarget > 0 && !targetConns.acquire(target, config.maxPerTarget) {
+			verboseLogger.Printf("Target %s is at -max-per-target, skipping it", target)
+			continue
+		}
+		if config.breakerFailures > 0 && !breakers.allow(target) {
+			verboseLogger.Printf("Circuit breaker for %s is open, skipping it", target)
+			releaseTarget(target)
+			err = errBreakerOpen
+			continue
+		}
+		var conn net.Conn
+		conn, err = dial(ctx, target)
+		if config.breakerFailures > 0 {
+			breakers.done(target, err)
+		}
+		if err == nil {
+			return conn, target, nil
+		}
+		releaseTarget(target)
+		metrics.dialFailed(routeName)
+		if errors.Is(context.Cause(ctx), errConnectBudget) {
+			return nil, target, fmt.Errorf("%w after %v (%d of %d targets tried)", errConnectBudget, config.connectBudget, i+1, len(targets))
+		}
+		if i < len(targets)-1 {
+			logger.Printf("Error connecting to target %s: %v, trying %s", target, err, targets[i+1])
+		}
+	}
+	return nil, targets[len(targets)-1], err
+}
+
+// dial connects to target with config.dialContext if an embedder set one,
+// and otherwise over TCP, resolving names with targetResolverDNS.
+func dial(ctx context.Context, target string) (net.Conn, error) {
+	if config.dialContext != nil {
+		return config.dialContext(ctx, target)
+	}
+	dialer := net.Dialer{Resolver: targetResolverDNS(), Control: controlDialer}
+	return dialer.DialContext(ctx, "tcp", target)
+}
+
+// freshResolver is the pure Go DNS resolver, which queries the name
+// servers on every lookup instead of going through the C library and any
+// caching daemon such as nscd behind it.
+var freshResolver = &net.Resolver{PreferGo: true}
+
+// targetResolverDNS returns the DNS resolver used for targets: freshResolver
+// with -target-resolve-each-connection, the system default otherwise.
+func targetResolverDNS() *net.Resolver {
+	if config.resolveEach {
+		return freshResolver
+	}
+	return net.DefaultResolver
+}
+
+// failClosedTimeout bounds each startup dial made for -fail-closed.
+const failClosedTimeout = 5 * time.Second
+
+// checkStaticTargets dials every statically configured target once, for
+// -fail-closed. Dynamically resolved targets such as -target-srv can't be
+// known in advance and are skipped.
+func checkStaticTargets() error {
+	var targets []string
+	if target, ok := config.resolver.(staticResolver); ok {
+		targets = append(targets, string(target))
+	}
+	for _, rt := range config.routes {
+		targets = append(targets, rt.target)
+	}
+	for _, target := range targets {
+		ctx, cancel := context.WithTimeout(context.Background(), failClosedTimeout)
+		conn, err := dial(ctx, target)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("target %s is unreachable: %w", target, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseDSCP parses a -dscp value: a number from 0 to 63 or one of the
+// standard code point names EF, CS0-CS7 and AF11-AF43.
+func parseDSCP(v string) (int, error) {
+	name := strings.ToUpper(v)
+	switch {
+	case name == "EF":
+		return 46, nil
+	case len(name) == 3 && strings.HasPrefix(name, "CS") && name[2] >= '0' && name[2] <= '7':
+		return int(name[2]-'0') << 3, nil
+	case len(name) == 4 && strings.HasPrefix(name, "AF") && name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3':
+		return int(name[2]-'0')<<3 | int(name[3]-'0')<<1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q: need 0-63 or a name such as EF or AF41", v)
+	}
+	return n, nil
+}
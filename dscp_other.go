@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "syscall"
+
+const dscpSupported = false
+
+func controlDialer(network, address string, c syscall.RawConn) error {
+	return nil
+}
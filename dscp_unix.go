@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+const dscpSupported = true
+
+// controlDialer marks target connections with -dscp before they connect,
+// setting IP_TOS on IPv4 sockets and IPV6_TCLASS on IPv6 ones. The DSCP is
+// the upper six bits of either byte; the low two are left to ECN.
+func controlDialer(network, address string, c syscall.RawConn) error {
+	if config.dscp == 0 {
+		return nil
+	}
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, config.dscp<<2)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, config.dscp<<2)
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,31 @@
+package main
+
+// echoTarget stands in for the target address of -echo sessions in logs
+// and metrics.
+const echoTarget = "(echo)"
+
+// echoMessages sends every message from the client straight back with the
+// same message type, for testing WebSocket clients without a backend.
+func echoMessages(conn *wsConn, sess *session, rec *recorder) {
+	sess.setTarget(echoTarget)
+	defer trackSession(sess)()
+	for {
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			sess.setCloseCause(readCause(err))
+			return
+		}
+		throttleTotal(2 * len(msg))
+		traceFrame(sess.id, toTarget, msg)
+		rec.write(toTarget, msg)
+		sess.count(toTarget, len(msg))
+		traceFrame(sess.id, toClient, msg)
+		rec.write(toClient, msg)
+		sess.count(toClient, len(msg))
+		if err := conn.WriteMessage(msgType, msg); err != nil {
+			sess.setCloseCause(causeError)
+			logger.Printf("Session %s: WebSocket write error: %v", sess.id, err)
+			return
+		}
+	}
+}
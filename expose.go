@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// exposeTargetHeader carries the resolved backends on the upgrade response
+// to clients allowed by -expose-target, so client developers can check
+// their routing.
+const exposeTargetHeader = "X-Proxy-Target"
+
+// prefixList is a set of client networks such as -expose-target takes.
+type prefixList []netip.Prefix
+
+// parsePrefixList parses comma-separated CIDRs; a bare IP stands for
+// itself alone.
+func parsePrefixList(v string) (prefixList, error) {
+	var list prefixList
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p.Masked())
+	}
+	return list, nil
+}
+
+// contains reports whether ip is in one of the networks. IPv4-mapped IPv6
+// addresses match the IPv4 networks.
+func (p prefixList) contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.WithZone("").Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// exposedTarget returns the upgrade response header naming targets, or nil
+// unless the client is in -expose-target.
+func exposedTarget(r *http.Request, targets []string) http.Header {
+	if len(targets) == 0 || !config.exposeTargetTo.contains(clientIP(r)) {
+		return nil
+	}
+	return http.Header{exposeTargetHeader: {strings.Join(targets, ", ")}}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExposedTargetIgnoresForgedForwardedFor(t *testing.T) {
+	defer func(trust bool, to prefixList) {
+		config.trustForwarded, config.exposeTargetTo = trust, to
+	}(config.trustForwarded, config.exposeTargetTo)
+	var err error
+	if config.exposeTargetTo, err = parsePrefixList("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	config.trustForwarded = true
+	targets := []string{"10.0.0.5:5900"}
+
+	// A client outside the list forges a loopback first hop; the trusted
+	// proxy appends the client's real address after it
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "127.0.0.1, 203.0.113.7")
+	if h := exposedTarget(r, targets); h != nil {
+		t.Errorf("exposedTarget for a forged hop = %v, want nil", h)
+	}
+
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 127.0.0.1")
+	if got := exposedTarget(r, targets).Get(exposeTargetHeader); got != "10.0.0.5:5900" {
+		t.Errorf("%s for a listed client = %q, want %q", exposeTargetHeader, got, "10.0.0.5:5900")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// supportedExtensions are the WebSocket extensions Gorilla can negotiate.
+// Gorilla implements only permessage-deflate, always without context
+// takeover, and ignores any other extension a client offers.
+var supportedExtensions = []string{"permessage-deflate"}
+
+// parseExtensions parses -ws-extensions: a comma-separated allowlist of
+// extension names, or "none".
+func parseExtensions(v string) ([]string, error) {
+	if v == "none" {
+		return []string{}, nil
+	}
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(supportedExtensions, name) {
+			return nil, fmt.Errorf("unsupported WebSocket extension %q (supported: %s)", name, strings.Join(supportedExtensions, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// filterExtensions removes the offers for extensions outside the
+// -ws-extensions allowlist from the request's Sec-WebSocket-Extensions
+// headers, so negotiation never depends on what the WebSocket library
+// happens to support.
+func filterExtensions(r *http.Request) {
+	if config.wsExtensions == nil {
+		return
+	}
+	var kept, dropped []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(header, ",") {
+			offer = strings.TrimSpace(offer)
+			if offer == "" {
+				continue
+			}
+			name, _, _ := strings.Cut(offer, ";")
+			if slices.Contains(config.wsExtensions, strings.ToLower(strings.TrimSpace(name))) {
+				kept = append(kept, offer)
+			} else {
+				dropped = append(dropped, offer)
+			}
+		}
+	}
+	if len(dropped) > 0 {
+		verboseLogger.Printf("Ignoring WebSocket extension offers from %s: %s", r.RemoteAddr, strings.Join(dropped, ", "))
+	}
+	r.Header.Del("Sec-WebSocket-Extensions")
+	if len(kept) > 0 {
+		r.Header.Set("Sec-WebSocket-Extensions", strings.Join(kept, ", "))
+	}
+}
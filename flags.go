@@ -0,0 +1,16 @@
+package main
+
+import "strings"
+
+// stringList is a flag.Value that collects every occurrence of a
+// repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
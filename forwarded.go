@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requestScheme returns the scheme the client used to reach the proxy:
+// the X-Forwarded-Proto set by a trusted reverse proxy, or otherwise
+// whether this server terminated TLS itself.
+func requestScheme(r *http.Request) string {
+	if config.trustForwarded {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		switch strings.ToLower(strings.TrimSpace(proto)) {
+		case "https", "wss":
+			return "https"
+		case "http", "ws":
+			return "http"
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// wsScheme returns the WebSocket scheme matching requestScheme.
+func wsScheme(r *http.Request) string {
+	if requestScheme(r) == "https" {
+		return "wss"
+	}
+	return "ws"
+}
+
+// clientIP returns the address of the client behind r: the last
+// X-Forwarded-For hop when forwarded headers are trusted, otherwise the
+// peer address of the connection. The last hop is the one the trusted proxy
+// appended; earlier ones come from the client and can be forged.
+func clientIP(r *http.Request) string {
+	if config.trustForwarded {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			hops := strings.Split(values[len(values)-1], ",")
+			if hop := strings.TrimSpace(hops[len(hops)-1]); hop != "" {
+				return hop
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
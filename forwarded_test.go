@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPTrustForwarded(t *testing.T) {
+	defer func(trust bool) { config.trustForwarded = trust }(config.trustForwarded)
+	config.trustForwarded = true
+	tests := []struct {
+		xff  []string
+		want string
+	}{
+		{nil, "192.0.2.1"},
+		{[]string{"203.0.113.7"}, "203.0.113.7"},
+		{[]string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{[]string{"1.2.3.4", "203.0.113.7"}, "203.0.113.7"},
+		{[]string{"1.2.3.4,"}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP with X-Forwarded-For %q = %q, want %q", tt.xff, got, tt.want)
+		}
+	}
+}
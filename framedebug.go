@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// frameDebugHeaderLen is the size of the header -frame-debug adds: a
+// big-endian uint64 sequence number followed by a big-endian int64 Unix
+// timestamp in nanoseconds.
+const frameDebugHeaderLen = 16
+
+// frameDebugger numbers the messages of one session for -frame-debug. Each
+// message to the client gets a header, and each message from the client
+// must carry one, which is checked and stripped before it goes to the
+// target. This breaks every real protocol and is only useful with a
+// cooperating debug client.
+type frameDebugger struct {
+	sessionID string
+	sendSeq   uint64
+	recvSeq   uint64
+}
+
+// newFrameDebugger returns nil unless -frame-debug is set; the nil value's
+// methods pass messages through untouched.
+func newFrameDebugger(sessionID string) *frameDebugger {
+	if !config.frameDebug {
+		return nil
+	}
+	return &frameDebugger{sessionID: sessionID}
+}
+
+// wrap returns p prefixed with the next outgoing header. It is only called
+// from the TCP to WebSocket goroutine.
+func (d *frameDebugger) wrap(p []byte) []byte {
+	if d == nil {
+		return p
+	}
+	msg := make([]byte, frameDebugHeaderLen+len(p))
+	binary.BigEndian.PutUint64(msg, d.sendSeq)
+	binary.BigEndian.PutUint64(msg[8:], uint64(time.Now().UnixNano()))
+	copy(msg[frameDebugHeaderLen:], p)
+	d.sendSeq++
+	return msg
+}
+
+// unwrap checks the header on a message from the client, logs gaps and
+// reordering, and returns the payload. It is only called from the
+// WebSocket to TCP loop.
+func (d *frameDebugger) unwrap(p []byte) []byte {
+	if d == nil {
+		return p
+	}
+	if len(p) < frameDebugHeaderLen {
+		logger.Printf("Session %s: frame-debug: %d byte message has no header", d.sessionID, len(p))
+		return p
+	}
+	seq := binary.BigEndian.Uint64(p)
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(p[8:])))
+	switch {
+	case seq > d.recvSeq:
+		logger.Printf("Session %s: frame-debug: expected message %d, got %d (%d dropped)", d.sessionID, d.recvSeq, seq, seq-d.recvSeq)
+	case seq < d.recvSeq:
+		logger.Printf("Session %s: frame-debug: message %d arrived out of order, expected %d", d.sessionID, seq, d.recvSeq)
+	}
+	if seq >= d.recvSeq {
+		d.recvSeq = seq + 1
+	}
+	verboseLogger.Printf("Session %s: frame-debug: message %d took %v", d.sessionID, seq, time.Since(sent))
+	return p[frameDebugHeaderLen:]
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// connectMessage is the parsed -connect-message.
+type connectMessage struct {
+	messageType int
+	data        []byte
+}
+
+// parseConnectMessage parses -connect-message: "hex:" followed by hex
+// digits is sent as a binary message, anything else as a text message.
+func parseConnectMessage(v string) (*connectMessage, error) {
+	if digits, ok := strings.CutPrefix(v, "hex:"); ok {
+		data, err := hex.DecodeString(digits)
+		if err != nil {
+			return nil, err
+		}
+		return &connectMessage{messageType: websocket.BinaryMessage, data: data}, nil
+	}
+	return &connectMessage{messageType: websocket.TextMessage, data: []byte(v)}, nil
+}
+
+// sendConnectMessage sends -connect-message to a freshly upgraded client.
+// Clients that negotiated the binary subprotocol, such as noVNC, expect the
+// VNC handshake to be the first thing they read, so they only get it with
+// -connect-message-vnc.
+func sendConnectMessage(conn *wsConn) error {
+	msg := config.connectMessage
+	if msg == nil || conn.Subprotocol() == "binary" && !config.connectMessageVNC {
+		return nil
+	}
+	return conn.WriteMessage(msg.messageType, msg.data)
+}
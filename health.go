@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthDialTimeout = 2 * time.Second
+	healthCacheTTL    = 5 * time.Second
+)
+
+// backendHealth caches the result of dialing the backend so frequent probes
+// don't hammer it.
+type backendHealth struct {
+	mu      sync.Mutex
+	target  string
+	checked time.Time
+	err     error
+}
+
+var health backendHealth
+
+// check dials the backend unless the last result is still fresh.
+func (h *backendHealth) check() (time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.checked) < healthCacheTTL {
+		return h.checked, h.err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthDialTimeout)
+	defer cancel()
+	conn, err := dial(ctx, h.target)
+	if err == nil {
+		conn.Close()
+	}
+	if config.breakerFailures > 0 {
+		breakers.done(h.target, err)
+	}
+	h.checked, h.err = time.Now(), err
+	return h.checked, h.err
+}
+
+// healthHandler serves /healthz. With -healthcheck-target it reports 503
+// while the backend can't be reached.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	body := map[string]string{"status": "ok", "scheme": requestScheme(r)}
+	if config.healthCheckTarget {
+		checked, err := health.check()
+		body["target"] = health.target
+		body["last_check"] = checked.Format(time.RFC3339)
+		if config.breakerFailures > 0 && breakers.isOpen(health.target) {
+			body["breaker"] = "open"
+		}
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			body["status"] = "unavailable"
+			body["error"] = err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// livezHandler serves the liveness probe: 200 while the process runs and
+// isn't draining.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, !draining.Load(), nil)
+}
+
+// readyzHandler serves the readiness probe: 200 while not draining and, with
+// -healthcheck-target, while the backend can be reached.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeProbe(w, false, nil)
+		return
+	}
+	var err error
+	if config.healthCheckTarget {
+		_, err = health.check()
+	}
+	writeProbe(w, err == nil, err)
+}
+
+func writeProbe(w http.ResponseWriter, ok bool, err error) {
+	body := map[string]string{"status": "ok"}
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+		body["status"] = "unavailable"
+		if draining.Load() {
+			body["status"] = "draining"
+		}
+		if err != nil {
+			body["error"] = err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>websockify</title></head>
+<body>
+<h1>Available targets</h1>
+<table>
+<tr><th>Name</th><th>Path</th></tr>
+{{range .}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td>{{.Path}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// indexEntry is one row of the -web-index page.
+type indexEntry struct {
+	Name string
+	Path string
+	URL  string
+}
+
+// indexHandler serves the -web-index page linking the noVNC client to every
+// configured route. Only route names are shown, never target addresses.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	var entries []indexEntry
+	if config.resolver != nil || config.targetWS != "" || config.echo {
+		entries = append(entries, indexEntry{Name: "default", Path: "/", URL: vncURL(r, "")})
+	}
+	for _, rt := range config.routes {
+		entries = append(entries, indexEntry{Name: strings.TrimPrefix(rt.path, "/"), Path: rt.path, URL: vncURL(r, rt.path)})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, entries); err != nil {
+		logger.Printf("Error rendering index: %v", err)
+	}
+}
+
+// vncURL returns the link opening the noVNC client against path. An empty
+// path leaves noVNC's default, which the catch-all handler proxies.
+func vncURL(r *http.Request, path string) string {
+	q := url.Values{}
+	if path != "" {
+		q.Set("path", strings.TrimPrefix(path, "/"))
+	}
+	if wsScheme(r) == "wss" {
+		q.Set("encrypt", "1")
+	}
+	u := config.webPrefix + "/vnc.html"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
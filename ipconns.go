@@ -0,0 +1,59 @@
+package main
+
+import "sync"
+
+// connCounter tracks active connections per key: per client IP for
+// -max-connections-per-ip and per target for -max-per-target.
+type connCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var (
+	ipConns     = connCounter{counts: make(map[string]int)}
+	targetConns = connCounter{counts: make(map[string]int)}
+)
+
+// acquire counts a new connection for key unless key already has limit
+// active connections.
+func (c *connCounter) acquire(key string, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key] >= limit {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+// release counts a connection for key as closed.
+func (c *connCounter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key] > 0 {
+		c.counts[key]--
+	}
+}
+
+// allFull reports whether every one of keys has limit active connections.
+func (c *connCounter) allFull(keys []string, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if c.counts[key] < limit {
+			return false
+		}
+	}
+	return true
+}
+
+// sweep drops the entries of keys without active connections.
+func (c *connCounter) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, n := range c.counts {
+		if n == 0 {
+			delete(c.counts, key)
+		}
+	}
+}
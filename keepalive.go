@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// keepalive watches the connection's idle time. Once it has been idle for
+// -ping-idle it pings the client, so NAT and firewall state survives quiet
+// sessions without adding pings to busy ones; with -pong-timeout, a client
+// that doesn't answer in time has its reads fail, which ends the session.
+// Once it has been idle for -idle-timeout the session is closed.
+// It returns a function that stops the watching; with neither flag set it
+// does nothing.
+func keepalive(sess *session) (stop func()) {
+	conn, sessionID := sess.conn, sess.id
+	if config.pingIdle <= 0 && config.idleTimeout <= 0 {
+		return func() {}
+	}
+	if config.pingIdle > 0 {
+		conn.SetPongHandler(func(string) error {
+			verboseLogger.Printf("Session %s: pong received", sessionID)
+			return conn.SetReadDeadline(conn.readDeadline())
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		var lastPing time.Time
+		timer := time.NewTimer(nextIdleCheck(0, lastPing))
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			idle := conn.idle()
+			if config.idleTimeout > 0 && idle >= config.idleTimeout {
+				logger.Printf("Session %s: idle for %v, closing", sessionID, idle.Round(100*time.Millisecond))
+				sess.setCloseCause(causeProxy)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"),
+					time.Now().Add(time.Second))
+				conn.Close()
+				return
+			}
+			// Traffic since the timer was armed pushes the ping back
+			if config.pingIdle > 0 && idle >= config.pingIdle && time.Since(lastPing) >= config.pingIdle {
+				if config.pongTimeout > 0 {
+					due := time.Now().Add(config.pongTimeout)
+					if d := conn.readDeadline(); !d.IsZero() && d.Before(due) {
+						due = d // -ws-read-deadline is due first
+					}
+					conn.SetReadDeadline(due)
+				}
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+					return
+				}
+				lastPing = time.Now()
+			}
+			timer.Reset(nextIdleCheck(idle, lastPing))
+		}
+	}()
+	return func() { close(done) }
+}
+
+// nextIdleCheck returns how long until the next ping or idle timeout can be
+// due, given the current idle time and when the last ping was sent.
+func nextIdleCheck(idle time.Duration, lastPing time.Time) time.Duration {
+	next := config.idleTimeout - idle
+	if config.pingIdle > 0 {
+		due := max(config.pingIdle-idle, config.pingIdle-time.Since(lastPing))
+		if config.idleTimeout <= 0 || due < next {
+			next = due
+		}
+	}
+	return max(next, time.Millisecond)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START).
+const listenFdsStart = 3
+
+// listen opens the TCP listener for addr and applies the socket tuning
+// options from config.
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: controlListener}
+	ln, err := lc.Listen(context.Background(), config.network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.listenBacklog > 0 {
+		if err := setListenBacklog(ln, config.listenBacklog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// exitBindFailed is the exit status when a listening socket can't be
+// bound, so supervisors can tell it apart from other failures.
+const exitBindFailed = 3
+
+// fatalBindError logs why binding addr failed, in plain words when the
+// cause is a common one, and exits with exitBindFailed.
+func fatalBindError(addr string, err error) {
+	if hint := bindErrorHint(addr, err); hint != "" {
+		logger.Printf("Cannot listen: %s (%v)", hint, err)
+	} else {
+		logger.Printf("Cannot listen on %s: %v", addr, err)
+	}
+	os.Exit(exitBindFailed)
+}
+
+// activationListener returns the listener inherited through systemd socket
+// activation, or nil if the process was not socket-activated. Only the first
+// passed socket is used.
+func activationListener() (net.Listener, error) {
+	if !socketActivated() {
+		return nil, nil
+	}
+	// Don't pass the sockets on to anything we might start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// socketActivated reports whether systemd passed this process any sockets.
+func socketActivated() bool {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return false
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	return err == nil && n > 0
+}
+
+const (
+	defaultListenHost  = "0.0.0.0"
+	defaultListenHost6 = "::"
+	defaultListenPort  = "6080"
+)
+
+// normalizeListenAddr completes a listen address given as a bare port
+// ("8080"), a host or IP literal without a port ("localhost", "::1"), or a
+// full host:port, filling in defaultListenHost (defaultListenHost6 with
+// -network tcp6) and defaultListenPort.
+func normalizeListenAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", errors.New("empty listen address")
+	}
+	if _, err := strconv.Atoi(addr); err == nil {
+		host := defaultListenHost
+		if config.network == "tcp6" {
+			host = defaultListenHost6
+		}
+		addr = net.JoinHostPort(host, addr)
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+
+	// No port: a host name or an IP literal, possibly bracketed and with a
+	// zone ("fe80::1%eth0") that JoinHostPort keeps inside the brackets
+	host := addr
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if strings.ContainsAny(host, "[]/ ") {
+		return "", fmt.Errorf("invalid listen address %q", addr)
+	}
+	if strings.ContainsAny(host, ":%") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+	}
+	return net.JoinHostPort(host, defaultListenPort), nil
+}
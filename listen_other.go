@@ -0,0 +1,24 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func controlListener(network, address string, c syscall.RawConn) error {
+	if config.reuseAddr {
+		return errors.New("-reuse-addr is not supported on this platform")
+	}
+	return nil
+}
+
+func setListenBacklog(ln net.Listener, backlog int) error {
+	return errors.New("-listen-backlog is not supported on this platform")
+}
+
+func bindErrorHint(addr string, err error) string {
+	return ""
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestNormalizeListenAddr(t *testing.T) {
+	tests := []struct {
+		network string
+		addr    string
+		want    string // "" when an error is expected
+	}{
+		{"tcp", "8080", "0.0.0.0:8080"},
+		{"tcp6", "8080", "[::]:8080"},
+		{"tcp", "localhost", "localhost:6080"},
+		{"tcp", "127.0.0.1", "127.0.0.1:6080"},
+		{"tcp", "::1", "[::1]:6080"},
+		{"tcp", "[::1]", "[::1]:6080"},
+		{"tcp", "[::1]:8080", "[::1]:8080"},
+		{"tcp", "localhost:8080", "localhost:8080"},
+		{"tcp", ":8080", ":8080"},
+		{"tcp", "0.0.0.0:http", "0.0.0.0:http"},
+		// Zone-scoped link-local addresses
+		{"tcp", "[fe80::1%eth0]:8080", "[fe80::1%eth0]:8080"},
+		{"tcp", "[fe80::1%eth0]", "[fe80::1%eth0]:6080"},
+		{"tcp", "fe80::1%eth0", "[fe80::1%eth0]:6080"},
+		{"tcp", "fe80::1%", ""},
+		{"tcp", "[fe80::1%eth0", ""},
+		{"tcp", "", ""},
+		{"tcp", "localhost:99999", ""},
+		{"tcp", "localhost:nosuchservice", ""},
+		{"tcp", "not a host", ""},
+		{"tcp", "[::1", ""},
+		{"tcp", "::zz", ""},
+	}
+	defer func(network string) { config.network = network }(config.network)
+	for _, tt := range tests {
+		config.network = tt.network
+		got, err := normalizeListenAddr(tt.addr)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("normalizeListenAddr(%q) = %q, want an error", tt.addr, got)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("normalizeListenAddr(%q) with -network %s = %q, %v; want %q", tt.addr, tt.network, got, err, tt.want)
+		}
+	}
+}
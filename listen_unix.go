@@ -0,0 +1,59 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// controlListener sets SO_REUSEADDR on the socket before it is bound.
+func controlListener(network, address string, c syscall.RawConn) error {
+	if !config.reuseAddr {
+		return nil
+	}
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// setListenBacklog calls listen(2) again on the already listening socket,
+// which replaces its accept queue length. The kernel still caps the value
+// (net.core.somaxconn on Linux).
+func setListenBacklog(ln net.Listener, backlog int) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// bindErrorHint explains the common reasons binding addr fails, or returns
+// "" for other errors.
+func bindErrorHint(addr string, err error) string {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Sprintf("address %s is already in use; is another instance running?", addr)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Sprintf("permission denied binding %s; ports below 1024 need root or CAP_NET_BIND_SERVICE", addr)
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return fmt.Sprintf("address %s is not available; is the IP assigned to this host?", addr)
+	}
+	return ""
+}
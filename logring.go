@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// logRing keeps the most recent log lines in memory for /admin/logs.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// recentLogs is set by -log-buffer; initLoggers tees every log line into it.
+var recentLogs *logRing
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size)}
+}
+
+// Write stores p, normally one complete log line as the log package writes
+// it, overwriting the oldest line once the ring is full.
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines[l.next] = string(p)
+	l.next++
+	if l.next == len(l.lines) {
+		l.next, l.full = 0, true
+	}
+	return len(p), nil
+}
+
+// snapshot returns the stored lines, oldest first.
+func (l *logRing) snapshot() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]string(nil), l.lines[:l.next]...)
+	}
+	return append(append([]string(nil), l.lines[l.next:]...), l.lines[:l.next]...)
+}
+
+// logsHandler serves the buffered log lines as plain text, oldest first.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	for _, line := range recentLogs.snapshot() {
+		io.WriteString(w, line)
+	}
+}
@@ -1,87 +1,486 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type appConfig struct {
-	targetAddr string
-	runOnce    bool
-	webServer  bool
+	targetAddr        string
+	runOnce           bool
+	webServer         bool
+	webFallback       bool
+	webPrefix         string
+	rootRedirect      string
+	adminAuth         *credentials
+	requireOrigin     bool
+	requireSubproto   bool
+	trustForwarded    bool
+	idPreamble        bool
+	connectMessage    *connectMessage
+	connectMessageVNC bool
+	forwardHeaders    []string
+	tcpReadBuffer     int
+	tcpNoDelay        bool
+	frameDebug        bool
+	echo              bool
+	trimTrailingNull  bool
+	controlChannel    bool
+	coalesce          time.Duration
+	wsBufferSize      int
+	maxFrameSize      int
+	maxBufferBytes    int
+	fallbackTarget    string
+	connectBudget     time.Duration
+	resolveEach       bool
+	targetWS          string
+	targetWSHeader    http.Header
+	targetWSForward   []string
+	targetWSProtos    bool
+	relayRespHeaders  []string
+	halfClose         bool
+	eagerDial         bool
+	drainTimeout      time.Duration
+	drainDeadline     time.Duration
+	shutdownCloseCode int
+	handshakeTimeout  time.Duration
+	pingIdle          time.Duration
+	pongTimeout       time.Duration
+	idleTimeout       time.Duration
+	tcpReadDeadline   time.Duration
+	wsReadDeadline    time.Duration
+	idleIgnoresCtrl   bool
+	health            bool
+	healthCheckTarget bool
+	compression       bool
+	compressionLevel  int
+	wsExtensions      []string
+	recordDir         string
+	recordCompress    bool
+	recordFormat      string
+	recordMaxBytes    int64
+	trace             bool
+	traceBytes        int
+	network           string
+	listenBacklog     int
+	reuseAddr         bool
+	maxMsgRate        int
+	maxConnsPerIP     int
+	maxPerTarget      int
+	breakerFailures   int
+	breakerWindow     time.Duration
+	breakerCooldown   time.Duration
+	dscp              int
+	allowedPorts      portRanges
+	exposeTargetTo    prefixList
+	msgRateClose      bool
+	routes            []route
+
+	sessionTickets   bool
+	ticketRotate     time.Duration
+	sessionCacheSize int
+	alpn             []string
+	clientCAFile     string
+	clientCRL        string
+	ocspStaple       string
+
+	// beforeUpgrade, if set, runs before the WebSocket upgrade and therefore
+	// before the origin check, for embedders that authenticate or rewrite
+	// handshakes; no flag sets it. Returning false aborts the request; the
+	// hook must then have written the response itself.
+	beforeUpgrade func(w http.ResponseWriter, r *http.Request) bool
+
+	// dialContext, if set, connects to TCP targets in place of net.Dialer,
+	// for embedders that tunnel to backends or replace them with in-memory
+	// pipes in tests. Session, health check and -fail-closed dials all use
+	// it.
+	dialContext func(ctx context.Context, target string) (net.Conn, error)
+
+	// resolver picks the target for requests not matched by a -route.
+	resolver targetResolver
 }
 
 var (
 	fileHandler   http.Handler
-	shouldExit    bool
+	indexPage     http.Handler
+	shouldExit    atomic.Bool
 	config        appConfig
 	logger        *log.Logger
 	verboseLogger *log.Logger
 )
 
 func ws(w http.ResponseWriter, r *http.Request) {
-	if shouldExit {
+	header := r.Header.Get("Connection")
+	upgrade := header != "" && strings.Contains(strings.ToLower(header), "upgrade")
+
+	// Send browsers to the UI hosted elsewhere
+	if config.rootRedirect != "" && !upgrade && r.URL.Path == "/" {
+		http.Redirect(w, r, config.rootRedirect, http.StatusFound)
 		return
 	}
 
 	// Serve static files if webServer is enabled and no WebSocket upgrade
 	if config.webServer {
-		if header := r.Header.Get("Connection"); header == "" || !strings.Contains(strings.ToLower(header), "upgrade") {
+		if !upgrade {
+			if indexPage != nil && r.URL.Path == config.webPrefix+"/" {
+				indexPage.ServeHTTP(w, r)
+				return
+			}
 			verboseLogger.Println("Serving file", r.URL)
 			fileHandler.ServeHTTP(w, r)
 			return
 		}
 	}
 
+	// Only -route paths are proxied when no default target is set
+	if config.resolver == nil && config.targetWS == "" && !config.echo {
+		http.NotFound(w, r)
+		return
+	}
+	proxy(w, r, proxyRoute{name: defaultRouteName, resolver: config.resolver, subprotocols: defaultSubprotocols, echo: config.echo, targetWS: config.targetWS != ""})
+}
+
+// defaultRouteName labels the metrics of sessions that aren't on a -route.
+const defaultRouteName = "default"
+
+// defaultSubprotocols are negotiated on routes that don't configure their
+// own. Like websockify, offer binary.
+var defaultSubprotocols = []string{"binary"}
+
+// proxyRoute is what proxy needs to know about the route a request came in
+// on.
+type proxyRoute struct {
+	// name labels the session's metrics; it is the configured route rather
+	// than the resolved target so the number of distinct labels stays
+	// bounded.
+	name         string
+	resolver     targetResolver
+	subprotocols []string
+	// echo sends the client's messages back instead of dialing a target.
+	echo bool
+	// targetWS proxies to the -target-ws backend instead of a TCP target.
+	// Only the default route does; -route paths keep their own targets.
+	targetWS bool
+}
+
+// proxy upgrades the request to a WebSocket and pipes it to the target
+// picked by rt's resolver.
+//
+// Requests refused by policy get a 4xx status and count as rejections;
+// those that can't be served because the server or the backends are
+// unavailable get 503.
+func proxy(w http.ResponseWriter, r *http.Request, rt proxyRoute) {
+	// Checked here rather than in ws so -route paths are covered too
+	if shouldExit.Load() {
+		http.Error(w, "Server has served its single session", http.StatusServiceUnavailable)
+		return
+	}
+	if draining.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if config.beforeUpgrade != nil && !config.beforeUpgrade(w, r) {
+		return
+	}
+	if hasBody(r) {
+		logger.Printf("Rejecting handshake from %s with a body (Content-Length %d)", r.RemoteAddr, r.ContentLength)
+		// Closing the connection keeps net/http from reading the body
+		// to reuse it
+		w.Header().Set("Connection", "close")
+		reject(w, rt.name, http.StatusBadRequest, rejectBody, "WebSocket handshakes must not have a body")
+		return
+	}
+
+	var targets []string
+	if !rt.targetWS && !rt.echo {
+		var err error
+		if targets, err = resolveTargets(rt.resolver, r); err != nil {
+			var reqErr requestError
+			if errors.As(err, &reqErr) {
+				logger.Printf("Cannot route %s: %v", r.URL, err)
+				reject(w, rt.name, http.StatusBadRequest, rejectBadTarget, "Cannot pick a target for this request: "+err.Error())
+				return
+			}
+			logger.Printf("Cannot resolve target for %s: %v", r.URL, err)
+			metrics.dialFailed(rt.name)
+			http.Error(w, "No backend available", http.StatusServiceUnavailable)
+			return
+		}
+		// Operator-configured targets are trusted; resolved ones are not
+		if _, static := rt.resolver.(staticResolver); !static && config.allowedPorts != nil {
+			if targets = filterAllowedTargets(targets); len(targets) == 0 {
+				reject(w, rt.name, http.StatusForbidden, rejectTargetPort, "Target port not allowed")
+				return
+			}
+		}
+		if targetsFull(targets, rt.name) {
+			logger.Printf("Refusing %s: every target is at -max-per-target", r.URL)
+			http.Error(w, "All backends are at capacity", http.StatusServiceUnavailable)
+			return
+		}
+		if open, retry := breakersOpen(targets, rt.name); open {
+			verboseLogger.Printf("Refusing %s: the circuit breaker of every target is open", r.URL)
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			http.Error(w, "All backends are failing, retry shortly", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if config.maxConnsPerIP > 0 {
+		ip := clientIP(r)
+		if !ipConns.acquire(ip, config.maxConnsPerIP) {
+			logger.Printf("Rejecting connection from %s: too many connections", ip)
+			reject(w, rt.name, http.StatusTooManyRequests, rejectConnLimit, "Too many connections from your address")
+			return
+		}
+		defer ipConns.release(ip)
+	}
+
+	if rampUp != nil {
+		if ok, retry := rampUp.admit(); !ok {
+			verboseLogger.Printf("Deferring connection from %s: -ramp-up limit reached", r.RemoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			http.Error(w, "Server is starting up, retry shortly", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	// Upgrade to WebSocket
 	if config.runOnce {
-		shouldExit = true
-		defer func() {
-			logger.Println("Run once! Exiting...")
-			os.Exit(0)
-		}()
+		// Only the request that flips shouldExit is served; deferred
+		// first, the signal fires after the session is fully torn down.
+		if !shouldExit.CompareAndSwap(false, true) {
+			http.Error(w, "Server has served its single session", http.StatusServiceUnavailable)
+			return
+		}
+		defer close(runOnceDone)
 	}
 
 	upgrader := websocket.Upgrader{
-		Subprotocols: []string{"binary"}, // Support binary data like websockify
+		Subprotocols:      rt.subprotocols,
+		EnableCompression: config.compression,
+		HandshakeTimeout:  config.handshakeTimeout,
+		ReadBufferSize:    config.wsBufferSize,
+		WriteBufferSize:   writeBufferSize(),
+		WriteBufferPool:   &wsWriteBufferPool,
 		CheckOrigin: func(r *http.Request) bool {
+			if config.requireOrigin && r.Header.Get("Origin") == "" {
+				logger.Printf("Rejecting upgrade from %s without Origin header", r.RemoteAddr)
+				metrics.rejected(rt.name, rejectOrigin)
+				return false
+			}
 			return true // Allow all origins for testing; replace with specific origins in production
 			// Example: return r.Header.Get("Origin") == "http://localhost:8080"
 		},
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if config.webServer && config.webFallback {
+		upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			verboseLogger.Printf("Upgrade failed (%v), serving file %s", reason, r.URL)
+			fileHandler.ServeHTTP(w, r)
+		}
+	}
+	var backend *wsConn
+	respHeader := exposedTarget(r, targets)
+	if rt.targetWS && (config.targetWSProtos || config.eagerDial || config.relayRespHeaders != nil) {
+		// The client can only be told the subprotocol the backend
+		// picked, or get its -relay-response-headers, once the backend
+		// has answered, so it is dialed before the client's upgrade;
+		// -eager-dial does the same for a clean failure
+		b, relayed, err := dialWebSocketTarget(r, rt.name)
+		if err != nil {
+			logger.Printf("Error connecting to WebSocket target %s: %v", redactURL(config.targetWS), err)
+			status := http.StatusServiceUnavailable
+			if config.eagerDial {
+				status = http.StatusBadGateway
+			}
+			http.Error(w, "No backend available", status)
+			return
+		}
+		defer b.Close()
+		backend = b
+		if relayed != nil {
+			if respHeader == nil {
+				respHeader = make(http.Header)
+			}
+			for name, v := range relayed {
+				respHeader[name] = v
+			}
+		}
+		if config.targetWSProtos {
+			upgrader.Subprotocols = nil
+			if p := b.Subprotocol(); p != "" {
+				upgrader.Subprotocols = []string{p}
+			}
+		}
+	}
+	var tcpConn net.Conn
+	var target string
+	var closeTarget func()
+	if config.eagerDial && !rt.targetWS && !rt.echo {
+		var err error
+		if tcpConn, target, err = dialTarget(r.Context(), targets, rt.name); err != nil {
+			logger.Printf("Error connecting to target %s: %v", target, err)
+			if errors.Is(err, errTargetsFull) {
+				http.Error(w, "All backends are at capacity", http.StatusServiceUnavailable)
+			} else if errors.Is(err, errBreakerOpen) {
+				http.Error(w, "All backends are failing, retry shortly", http.StatusServiceUnavailable)
+			} else {
+				http.Error(w, "No backend available", http.StatusBadGateway)
+			}
+			return
+		}
+		closeTarget = onceCloser(tcpConn)
+		defer closeTarget()
+		defer releaseTarget(target)
+	}
+	if config.requireSubproto && !sharesSubprotocol(upgrader.Subprotocols, websocket.Subprotocols(r)) {
+		logger.Printf("Rejecting upgrade from %s: no supported subprotocol in %q (supported: %q)",
+			r.RemoteAddr, websocket.Subprotocols(r), upgrader.Subprotocols)
+		reject(w, rt.name, http.StatusBadRequest, rejectSubprotocol, "No supported WebSocket subprotocol; this server speaks "+strings.Join(upgrader.Subprotocols, ", "))
+		return
+	}
+	filterExtensions(r)
+	c, err := upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
 		logger.Printf("Error upgrading to WebSocket: %v", err)
 		return
 	}
-	verboseLogger.Printf("Received connection from %s", conn.RemoteAddr())
+	conn := newWSConn(c)
+	conn.maxFrame = config.maxFrameSize
+	conn.readTimeout = config.wsReadDeadline
+	if config.compression {
+		conn.SetCompressionLevel(config.compressionLevel)
+	}
+	sessionID := newSessionID()
+	sni := serverName(r)
+	verboseLogger.Printf("Received %s connection from %s%s (session %s)", wsScheme(r), conn.RemoteAddr(), forServerName(sni), sessionID)
 	defer conn.Close()
 
-	// Dial target TCP
-	tcpConn, err := net.Dial("tcp", config.targetAddr)
+	sess := &session{id: sessionID, route: rt.name, clientIP: clientIP(r), serverName: sni, started: time.Now(), conn: conn,
+		traceParent: r.Header.Get("traceparent")}
+	sessions.add(sess)
+	defer sessions.remove(sess)
+	defer keepalive(sess)()
+	if err := sendConnectMessage(conn); err != nil {
+		logger.Printf("Session %s: cannot send connect message: %v", sessionID, err)
+		return
+	}
+
+	rec, err := newRecorder(sessionID)
 	if err != nil {
-		logger.Printf("Error connecting to target %s: %v", config.targetAddr, err)
+		logger.Printf("Session %s: cannot record: %v", sessionID, err)
+	}
+	defer rec.close()
+
+	if rt.echo {
+		echoMessages(conn, sess, rec)
 		return
 	}
-	defer tcpConn.Close()
+	if rt.targetWS {
+		proxyWebSocket(conn, r, sess, rec, backend)
+		return
+	}
+
+	// Dial target TCP, unless -eager-dial already did
+	if tcpConn == nil {
+		tcpConn, target, err = dialTarget(r.Context(), targets, rt.name)
+		if err != nil {
+			logger.Printf("Error connecting to target %s: %v", target, err)
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, dialFailureReason(err)),
+				time.Now().Add(time.Second))
+			return
+		}
+		closeTarget = onceCloser(tcpConn)
+		defer closeTarget()
+		defer releaseTarget(target)
+	}
+	verboseLogger.Printf("Session %s connected to target %s", sessionID, target)
+	sess.setTarget(target)
+	rec.setTarget(target)
+	defer trackSession(sess)()
+	setNoDelay(tcpConn)
+
+	if config.idPreamble {
+		if _, err := fmt.Fprintf(tcpConn, "X-Session-ID: %s\n", sessionID); err != nil {
+			logger.Printf("TCP write error: %v", err)
+			return
+		}
+	}
+	if len(config.forwardHeaders) > 0 {
+		if err := writeHeaderPreamble(tcpConn, r); err != nil {
+			logger.Printf("TCP write error: %v", err)
+			return
+		}
+	}
+
+	var msgLimiter *tokenBucket
+	if config.maxMsgRate > 0 {
+		msgLimiter = newTokenBucket(float64(config.maxMsgRate), float64(config.maxMsgRate))
+	}
+
+	frames := newFrameDebugger(sessionID)
 
 	// TCP to WebSocket
 	go func() {
 		defer verboseLogger.Printf("Closed TCP to WS connection from %s", conn.RemoteAddr())
-		defer conn.Close()
-		defer tcpConn.Close()
-		buf := make([]byte, 1024)
+		halfClosed := false
+		defer func() {
+			if !halfClosed {
+				conn.Close()
+				closeTarget()
+			}
+		}()
+		bufp := tcpBufferPool.Get().(*[]byte)
+		defer tcpBufferPool.Put(bufp)
+		buf := *bufp
 		for {
-			n, err := tcpConn.Read(buf)
+			if config.tcpReadDeadline > 0 {
+				tcpConn.SetReadDeadline(time.Now().Add(config.tcpReadDeadline))
+			}
+			n, err := readCoalesced(tcpConn, buf)
 			if err != nil {
-				if err != io.EOF {
+				if config.halfClose && errors.Is(err, io.EOF) {
+					// Keep forwarding client data to the target until
+					// the client answers our close frame
+					verboseLogger.Printf("Session %s: target closed its write side", sessionID)
+					sess.setCloseCause(causeBackend)
+					halfClosed = true
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, "target closed"),
+						time.Now().Add(time.Second))
+					return
+				}
+				// EOF is the target hanging up and ErrClosed our own
+				// teardown closing the socket, or ErrClosedPipe for an
+				// in-memory target from dialContext; none is an error.
+				switch {
+				case errors.Is(err, io.EOF):
+					sess.setCloseCause(causeBackend)
+				case errors.Is(err, os.ErrDeadlineExceeded):
+					sess.setCloseCause(causeProxy)
+					logger.Printf("Session %s: no data from target for %v, closing", sessionID, config.tcpReadDeadline)
+				case !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe):
+					sess.setCloseCause(causeError)
 					logger.Printf("TCP read error: %v", err)
 				}
 				return
@@ -89,27 +488,82 @@ func ws(w http.ResponseWriter, r *http.Request) {
 			if n == 0 {
 				continue
 			}
-			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+			throttleTotal(n)
+			traceFrame(sessionID, toClient, buf[:n])
+			rec.write(toClient, buf[:n])
+			sess.count(toClient, n)
+			if config.maxBufferBytes > 0 && clientTooSlow(sess, n) {
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, frames.wrap(buf[:n])); err != nil {
+				sess.setCloseCause(causeError)
 				logger.Printf("WebSocket write error: %v", err)
 				return
 			}
 		}
 	}()
 
-	// WebSocket to TCP
+	// WebSocket to TCP, reusing one buffer for every message of the session
+	var msgBuf bytes.Buffer
+	// targetWriteClosed is set once a -half-close disconnect has closed the
+	// target's write side
+	targetWriteClosed := false
 	for {
-		msgType, msg, err := conn.ReadMessage()
+		msgType, r, err := conn.NextReader()
 		if err != nil {
-			if err != websocket.ErrCloseSent {
-				logger.Printf("WebSocket read error: %v", err)
+			if !errors.Is(err, websocket.ErrCloseSent) && !errors.Is(err, net.ErrClosed) {
+				sess.readFailed(err)
 			}
 			return
 		}
+		if msgLimiter != nil {
+			if config.msgRateClose {
+				if !msgLimiter.allow() {
+					logger.Printf("Message rate limit exceeded by %s, closing", conn.RemoteAddr())
+					sess.setCloseCause(causeProxy)
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "message rate exceeded"),
+						time.Now().Add(time.Second))
+					return
+				}
+			} else {
+				time.Sleep(msgLimiter.reserve(1))
+			}
+		}
+		if msgType == websocket.TextMessage && config.controlChannel {
+			switch handleControl(sess, tcpConn, closeTarget, r) {
+			case controlStop:
+				return
+			case controlWriteClosed:
+				targetWriteClosed = true
+			}
+			continue
+		}
 		if msgType != websocket.BinaryMessage {
 			logger.Println("Non-binary message received")
 			continue
 		}
+		if targetWriteClosed {
+			// The client asked to disconnect; wait for the target's EOF
+			verboseLogger.Printf("Session %s: dropping client data sent after disconnect", sessionID)
+			continue
+		}
+		msgBuf.Reset()
+		if _, err := msgBuf.ReadFrom(r); err != nil {
+			sess.readFailed(err)
+			return
+		}
+		msg := frames.unwrap(msgBuf.Bytes())
+		if config.trimTrailingNull {
+			// Works around clients that pad their frames with NULs
+			msg = bytes.TrimRight(msg, "\x00")
+		}
+		throttleTotal(len(msg))
+		traceFrame(sessionID, toTarget, msg)
+		rec.write(toTarget, msg)
+		sess.count(toTarget, len(msg))
 		if _, err := tcpConn.Write(msg); err != nil {
+			sess.setCloseCause(causeError)
 			logger.Printf("TCP write error: %v", err)
 			return
 		}
@@ -119,10 +573,112 @@ func ws(w http.ResponseWriter, r *http.Request) {
 func main() {
 	helpFlag := flag.Bool("h", false, "Print help")
 	verboseFlag := flag.Bool("v", false, "Enable verbose logging")
+	syslogFlag := flag.Bool("syslog", false, "Log to the local syslog daemon instead of stdout")
+	syslogAddrFlag := flag.String("syslog-addr", "", "Log to the remote syslog daemon at `[udp://|tcp://]HOST:PORT` (implies -syslog)")
+	otlpEndpointFlag := flag.String("otlp-endpoint", "", "Export a trace span per session to the OpenTelemetry collector at `URL` (OTLP/HTTP, e.g. http://localhost:4318)")
+	cpuProfileFlag := flag.String("cpuprofile", "", "Write a CPU profile to `FILE` on shutdown")
+	memProfileFlag := flag.String("memprofile", "", "Write a heap profile to `FILE` on shutdown")
+	statsdAddrFlag := flag.String("statsd-addr", "", "Send StatsD metrics over UDP to `HOST:PORT`")
+	statsdPrefixFlag := flag.String("statsd-prefix", "websockify", "Prefix of the StatsD metric names")
+	statsdTagsFlag := flag.Bool("statsd-tags", true, "Add DogStatsD route tags to StatsD metrics")
+	metricsAddrFlag := flag.String("metrics-addr", "", "Serve Prometheus metrics at /metrics on a separate `ADDR` such as localhost:9090 (off by default)")
+	metricsAuthFlag := flag.String("metrics-auth", "", "Require `USER:PASS` basic auth for -metrics-addr, independently of -admin-auth")
+	pprofAddrFlag := flag.String("pprof-addr", "", "Serve net/http/pprof on a separate `ADDR` such as localhost:6060 (off by default)")
+	logFormatFlag := flag.String("log-format", "text", "Log output format: text or json")
+	adminSessionsFlag := flag.Bool("admin-sessions", false, "Serve the running sessions at /admin/sessions and terminate them with DELETE /admin/sessions/ID (requires -admin-auth)")
+	logBufferFlag := flag.Int("log-buffer", 0, "Keep the last `LINES` log lines in memory and serve them at /admin/logs (requires -admin-auth)")
+	checkFlag := flag.Bool("check", false, "Validate the configuration and exit without serving")
+	traceFlag := flag.Bool("trace", false, "Hexdump proxied frames to the verbose log (implies -v, very noisy)")
+	traceBytesFlag := flag.Int("trace-bytes", 256, "Maximum bytes of each frame dumped by -trace")
 	cert := flag.String("cert", "", "SSL certificate file")
 	key := flag.String("key", "", "SSL private key file")
 	webDir := flag.String("web", "", "Serve files from DIR")
+	embeddedWebFlag := flag.Bool("embedded-web", false, "Serve the web files built into the binary with -tags embedweb, instead of -web")
+	rootRedirectFlag := flag.String("root-redirect", "", "Redirect plain browser requests for / to `URL`, such as a noVNC UI hosted elsewhere")
+	webPrefixFlag := flag.String("web-prefix", "", "URL path `PREFIX` under which -web files are served")
+	testPageFlag := flag.Bool("test-page", false, "DEBUG ONLY: serve a built-in test client at /websockify-test that hexdumps received data and sends typed input (behind -admin-auth if set)")
+	webIndexFlag := flag.Bool("web-index", false, "Serve a page at the -web root linking the noVNC client to every route")
+	adminAuthFlag := flag.String("admin-auth", "", "Require `USER:PASS` basic auth for admin pages such as -web-index")
+	webFallbackFlag := flag.Bool("web-fallback", false, "Serve the requested file from -web when a WebSocket upgrade fails")
 	runOnceFlag := flag.Bool("run-once", false, "Handle a single WebSocket connection and exit")
+	networkFlag := flag.String("network", "tcp", "Network to listen on: tcp (dual-stack where possible), tcp4 or tcp6")
+	listenBacklogFlag := flag.Int("listen-backlog", 0, "Accept queue length for the listening socket (0 uses the OS default)")
+	reuseAddrFlag := flag.Bool("reuse-addr", false, "Set SO_REUSEADDR on the listening socket")
+	reaperIntervalFlag := flag.Duration("reaper-interval", reaperIntervalDefault, "How often entries of clients without connections are dropped from the per-client tables")
+	dscpFlag := flag.String("dscp", "", "Mark target connections with the DSCP `CODE`, a number from 0 to 63 or a name such as EF or AF41, for QoS (Unix only)")
+	acceptProxyFlag := flag.Bool("accept-proxy", false, "Expect a PROXY protocol v1 or v2 header from a load balancer on every connection and take the client address from it; connections without one are dropped")
+	rampUpFlag := flag.Duration("ramp-up", 0, "After startup, limit how fast new sessions start for this long, rising from 1 per second to -ramp-up-rate, to spread out reconnection storms (0 disables)")
+	rampUpRateFlag := flag.Float64("ramp-up-rate", 50, "New sessions per second allowed at the end of -ramp-up")
+	maxPerTargetFlag := flag.Int("max-per-target", 0, "Maximum concurrent sessions per TCP target; full targets are skipped in favor of other candidates (0 means unlimited)")
+	breakerFailuresFlag := flag.Int("breaker-failures", 0, "Open a target's circuit breaker after this many consecutive dial failures within -breaker-window, refusing connections to it without dialing (0 disables)")
+	breakerWindowFlag := flag.Duration("breaker-window", time.Minute, "Time within which -breaker-failures dial failures open a circuit breaker")
+	breakerCooldownFlag := flag.Duration("breaker-cooldown", 30*time.Second, "How long an open circuit breaker refuses connections before letting one through to probe the target")
+	maxConnsPerIPFlag := flag.Int("max-connections-per-ip", 0, "Maximum concurrent WebSocket connections per client IP (0 means unlimited)")
+	totalRateFlag := flag.Int("total-rate", 0, "Maximum bytes per second proxied by all connections together, in both directions (0 means unlimited)")
+	maxMsgRateFlag := flag.Int("max-msg-rate", 0, "Maximum WebSocket messages per second per connection (0 means unlimited)")
+	msgRateActionFlag := flag.String("msg-rate-action", "delay", "What to do with messages over -max-msg-rate: delay or close")
+	sessionTicketsFlag := flag.Bool("tls-session-tickets", true, "Allow TLS session resumption with session tickets")
+	ticketRotateFlag := flag.Duration("tls-ticket-rotate", 0, "Rotate session ticket keys at this interval (0 uses Go's built-in rotation)")
+	sessionCacheSizeFlag := flag.Int("tls-session-cache-size", 4, "Number of rotated session ticket keys that still resume sessions")
+	ocspStapleFlag := flag.String("ocsp-staple", "", "Staple the DER OCSP response in `FILE` to TLS handshakes, re-reading it hourly")
+	clientCRLFlag := flag.String("client-crl", "", "Reject -client-ca client certificates revoked by the CRLs in `FILE` (DER, or PEM with one CRL per CA), reloaded when it changes")
+	clientCAFlag := flag.String("client-ca", "", "Require TLS clients to present a certificate signed by a CA in the PEM `FILE`, reloaded when it changes")
+	alpnFlag := flag.String("tls-alpn", "", "Comma-separated ALPN `PROTOCOLS` to advertise, e.g. http/1.1 or h2,http/1.1 (must include http/1.1)")
+	tcpReadBufferFlag := flag.Int("tcp-read-buffer", 1024, "Size in bytes of each TCP read forwarded to the WebSocket client")
+	controlChannelFlag := flag.Bool("control-channel", false, "Treat text messages from the client as JSON control commands such as {\"cmd\":\"disconnect\"}")
+	echoFlag := flag.Bool("echo", false, "TESTING ONLY: echo every client message back instead of proxying to a target")
+	trimTrailingNullFlag := flag.Bool("trim-trailing-null", false, "Strip trailing NUL bytes from client messages before writing them to the target, for clients that pad frames; corrupts binary protocols whose data may end in NULs")
+	frameDebugFlag := flag.Bool("frame-debug", false, "DEBUG ONLY: prefix each message with a sequence number and timestamp and expect the same from the client; breaks normal clients")
+	tcpNoDelayFlag := flag.Bool("tcp-nodelay", true, "Disable Nagle's algorithm on target connections")
+	coalesceFlag := flag.Duration("coalesce", 0, "Wait up to this long for more target data to fill -tcp-read-buffer before sending a message (0 sends each read)")
+	maxBufferBytesFlag := flag.Int("max-buffer-bytes", 0, "Close sessions whose client has more than this many bytes sent but unacknowledged, as too slow; must be below the socket send buffer, which caps what can be unacknowledged (0 means unlimited, Linux only)")
+	maxFrameSizeFlag := flag.Int("max-frame-size", 0, "Split messages to the client into WebSocket frames of at most this many bytes of payload (0 sends each message as one frame)")
+	wsBufferSizeFlag := flag.Int("ws-buffer-size", 0, "Size in bytes of the WebSocket read and write buffers (0 uses 4096)")
+	connectMessageFlag := flag.String("connect-message", "", "Send `MSG` to the client right after the upgrade, as text or as binary if written hex:DIGITS")
+	connectMessageVNCFlag := flag.Bool("connect-message-vnc", false, "Also send -connect-message to clients that negotiated the binary (VNC) subprotocol")
+	forwardHeadersFlag := flag.String("forward-headers", "", "Send the handshake's `NAMES` headers (comma-separated, e.g. Cookie,Authorization) to the target as an HTTP-style header block before any client data")
+	idPreambleFlag := flag.Bool("session-id-preamble", false, "Send \"X-Session-ID: <id>\\n\" to the target before any client data")
+	targetWSFlag := flag.String("target-ws", "", "Proxy the default path to the WebSocket server at `URL` instead of a TCP target; -route paths keep their own targets")
+	connectBudgetFlag := flag.Duration("connect-budget", 0, "Give up connecting a session to its target after this long in total, across all -target-srv and -fallback-target attempts (0 waits for each dial to fail)")
+	eagerDialFlag := flag.Bool("eager-dial", false, "Connect to the target before completing the WebSocket upgrade and answer 502 if it is unreachable, instead of closing the upgraded connection with 1013")
+	relayRespHeadersFlag := flag.String("relay-response-headers", "", "Comma-separated `NAMES` of headers, such as Set-Cookie, to copy from the -target-ws backend's handshake response into the client's")
+	targetWSSubprotocolsFlag := flag.Bool("target-ws-subprotocols", false, "Offer the -target-ws backend the client's subprotocols and answer the client with the one the backend picks")
+	var targetWSHeaderFlags stringList
+	flag.Var(&targetWSHeaderFlags, "target-ws-header", "Send `\"NAME: VALUE\"` to the -target-ws backend, or forward the client's NAME header if no value is given (repeatable)")
+	targetSRVFlag := flag.String("target-srv", "", "Discover targets from the DNS SRV records of `NAME` (e.g. _vnc._tcp.example.com)")
+	targetTemplateFlag := flag.String("target-template", "", "Build the target from `TEMPLATE` such as backend-{token}.internal:5900, filling {name} from query parameters and {N} from path segments")
+	resolveEachFlag := flag.Bool("target-resolve-each-connection", false, "Resolve target names afresh for every connection, bypassing the -target-srv cache and system DNS caches")
+	exposeTargetFlag := flag.String("expose-target", "", "Name the resolved backend in an X-Proxy-Target upgrade response header to clients in the comma-separated `CIDRS` (reveals internal addresses)")
+	allowedPortsFlag := flag.String("allowed-ports", "", "`PORTS` dynamically resolved targets may use, e.g. 5900-5999,6080 (default any)")
+	failClosedFlag := flag.Bool("fail-closed", false, "Dial the configured targets once at startup and exit if any is unreachable")
+	fallbackTargetFlag := flag.String("fallback-target", "", "Target `HOST:PORT` dialed when the default target is unreachable; -route targets don't fall back")
+	requireSubprotocolFlag := flag.Bool("require-subprotocol", false, "Reject WebSocket upgrades that offer no supported subprotocol (HTTP 400)")
+	requireOriginFlag := flag.Bool("require-origin", false, "Reject WebSocket upgrades that carry no Origin header (HTTP 403)")
+	enableCORSFlag := flag.Bool("enable-cors", false, "Answer CORS preflight OPTIONS requests with 204 and CORS headers")
+	trustForwardedFlag := flag.Bool("trust-forwarded", false, "Trust X-Forwarded-* headers set by a reverse proxy in front of this server")
+	healthFlag := flag.Bool("health", false, "Serve JSON health endpoints at /healthz, /livez and /readyz")
+	healthCheckTargetFlag := flag.Bool("healthcheck-target", false, "Make /healthz dial the target and report 503 when it is unreachable (implies -health)")
+	shutdownCloseCodeFlag := flag.Int("shutdown-close-code", shutdownCloseCodeDefault, "WebSocket close code sent to sessions still open when -drain-timeout expires")
+	drainTimeoutFlag := flag.Duration("drain-timeout", drainTimeoutDefault, "How long to wait for sessions to end on SIGINT/SIGTERM")
+	drainDeadlineFlag := flag.Duration("drain-deadline", 0, "Exit with status 4 if sessions are still open this long after SIGINT/SIGTERM (0 means 1s after -drain-timeout)")
+	halfCloseFlag := flag.Bool("half-close", false, "On EOF from the target, close only the target-to-client direction and keep forwarding client data")
+	wsExtensionsFlag := flag.String("ws-extensions", "", "Comma-separated WebSocket `EXTENSIONS` clients may negotiate, or none (default: permessage-deflate with -compression)")
+	compressionFlag := flag.Bool("compression", false, "Negotiate permessage-deflate compression with clients")
+	compressionLevelFlag := flag.Int("compression-level", 3, "Deflate level 0-9 used with -compression")
+	pingIdleFlag := flag.Duration("ping-idle", 0, "Ping the client after this long without traffic (0 disables keepalive pings)")
+	pongTimeoutFlag := flag.Duration("pong-timeout", 0, "Close the session if a -ping-idle ping isn't answered within this long (0 waits forever)")
+	idleTimeoutFlag := flag.Duration("idle-timeout", 0, "Close sessions that carry no data for this long (0 disables)")
+	tcpReadDeadlineFlag := flag.Duration("tcp-read-deadline", 0, "Close sessions when a single read from the TCP target blocks for longer than this, waiting for data included (0 disables)")
+	wsReadDeadlineFlag := flag.Duration("ws-read-deadline", 0, "Close sessions when reading a single message from the client, waiting for it included, takes longer than this (0 disables)")
+	idleIgnoresControlFlag := flag.Bool("idle-ignores-control", false, "Only count binary messages from the client as activity for -idle-timeout and -ping-idle, not text or -control-channel messages")
+	handshakeTimeoutFlag := flag.Duration("handshake-timeout", 5*time.Second, "Maximum time for a client to send its request headers and complete the WebSocket handshake (0 means no limit)")
+	maxHeaderBytesFlag := flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size in bytes of HTTP request headers")
+	recordFlag := flag.String("record", "", "Record the traffic of each session to files in `DIR`")
+	recordFormatFlag := flag.String("record-format", "raw", "Format of -record captures: raw (one file of bytes per direction) or pcap (one timestamped capture for Wireshark)")
+	recordCompressFlag := flag.Bool("record-compress", false, "Gzip -record capture files")
+	recordMaxBytesFlag := flag.Int64("record-max-bytes", 0, "Stop recording a session after this many bytes (0 means unlimited)")
+	var routeFlags stringList
+	flag.Var(&routeFlags, "route", "Proxy WebSocket `PATH=HOST:PORT[;PROTOS]` to its own target, negotiating the comma-separated subprotocols PROTOS instead of binary (repeatable)")
 	flag.Parse()
 
 	if *helpFlag {
@@ -131,52 +687,512 @@ func main() {
 	}
 
 	// Initialize loggers
-	logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
-	if *verboseFlag {
-		verboseLogger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
-	} else {
-		verboseLogger = log.New(io.Discard, "", 0)
+	useSyslog := *syslogFlag || *syslogAddrFlag != ""
+	if *logBufferFlag < 0 {
+		log.Fatal("-log-buffer must not be negative")
+	}
+	if *logBufferFlag > 0 {
+		recentLogs = newLogRing(*logBufferFlag)
+	}
+	if err := initLoggers(*logFormatFlag, *verboseFlag || *traceFlag, useSyslog, *syslogAddrFlag); err != nil {
+		log.Fatal(err)
 	}
 
 	// Set config
+	config.trace = *traceFlag
+	config.traceBytes = *traceBytesFlag
 	config.runOnce = *runOnceFlag
+	switch *networkFlag {
+	case "tcp", "tcp4", "tcp6":
+		config.network = *networkFlag
+	default:
+		logger.Fatalf("Invalid -network %q: use tcp, tcp4 or tcp6", *networkFlag)
+	}
+	config.listenBacklog = *listenBacklogFlag
+	config.reuseAddr = *reuseAddrFlag
+	config.maxMsgRate = *maxMsgRateFlag
+	if *totalRateFlag < 0 {
+		logger.Fatal("-total-rate must not be negative")
+	}
+	if *totalRateFlag > 0 {
+		// A second's worth of burst lets idle periods absorb short spikes
+		totalLimiter = newTokenBucket(float64(*totalRateFlag), float64(*totalRateFlag))
+	}
+	config.maxConnsPerIP = *maxConnsPerIPFlag
+	config.maxPerTarget = *maxPerTargetFlag
+	if *breakerFailuresFlag < 0 {
+		logger.Fatal("-breaker-failures must not be negative")
+	}
+	if *breakerFailuresFlag > 0 && (*breakerWindowFlag <= 0 || *breakerCooldownFlag <= 0) {
+		logger.Fatal("-breaker-window and -breaker-cooldown must be positive")
+	}
+	config.breakerFailures = *breakerFailuresFlag
+	config.breakerWindow = *breakerWindowFlag
+	config.breakerCooldown = *breakerCooldownFlag
+	if *rampUpFlag > 0 {
+		if *rampUpRateFlag < 1 {
+			logger.Fatal("-ramp-up-rate must be at least 1")
+		}
+		rampUp = newRampLimiter(*rampUpFlag, *rampUpRateFlag)
+	}
+	if *reaperIntervalFlag <= 0 {
+		logger.Fatal("-reaper-interval must be positive")
+	}
+	var sweeps []func()
+	if config.maxConnsPerIP > 0 {
+		sweeps = append(sweeps, ipConns.sweep)
+	}
+	if config.maxPerTarget > 0 {
+		sweeps = append(sweeps, targetConns.sweep)
+	}
+	if config.breakerFailures > 0 {
+		sweeps = append(sweeps, breakers.sweep)
+	}
+	defer startReaper(*reaperIntervalFlag, sweeps)()
+	if *otlpEndpointFlag != "" {
+		exp, err := newOTLPExporter(*otlpEndpointFlag)
+		if err != nil {
+			logger.Fatalf("-otlp-endpoint: %v", err)
+		}
+		tracer = exp
+		defer tracer.shutdown()
+	}
+	if *statsdAddrFlag != "" {
+		sink, err := newStatsdSink(*statsdAddrFlag, *statsdPrefixFlag, *statsdTagsFlag)
+		if err != nil {
+			logger.Fatalf("-statsd-addr: %v", err)
+		}
+		metrics = append(metrics, sink)
+	}
+	var metricsHandler http.Handler
+	if *metricsAddrFlag != "" {
+		sink := newPromSink()
+		metrics = append(metrics, sink)
+		metricsHandler = sink
+		if *metricsAuthFlag != "" {
+			creds, err := parseCredentials(*metricsAuthFlag)
+			if err != nil {
+				logger.Fatalf("Invalid -metrics-auth: %v", err)
+			}
+			metricsHandler = requireAuth(creds, "websockify metrics", metricsHandler)
+		}
+	} else if *metricsAuthFlag != "" {
+		logger.Fatal("-metrics-auth requires -metrics-addr")
+	}
+	switch *msgRateActionFlag {
+	case "delay":
+	case "close":
+		config.msgRateClose = true
+	default:
+		logger.Fatalf("Invalid -msg-rate-action %q: must be delay or close", *msgRateActionFlag)
+	}
+	config.idPreamble = *idPreambleFlag
+	if *connectMessageFlag != "" {
+		msg, err := parseConnectMessage(*connectMessageFlag)
+		if err != nil {
+			logger.Fatalf("-connect-message: %v", err)
+		}
+		config.connectMessage = msg
+		config.connectMessageVNC = *connectMessageVNCFlag
+	}
+	if *forwardHeadersFlag != "" {
+		if *targetWSFlag != "" {
+			logger.Fatal("-forward-headers only works with TCP targets; use -target-ws-header with -target-ws")
+		}
+		names, err := parseHeaderList(*forwardHeadersFlag)
+		if err != nil {
+			logger.Fatalf("-forward-headers: %v", err)
+		}
+		config.forwardHeaders = names
+	}
+	config.recordDir = *recordFlag
+	config.recordCompress = *recordCompressFlag
+	switch *recordFormatFlag {
+	case "raw", "pcap":
+		config.recordFormat = *recordFormatFlag
+	default:
+		logger.Fatalf("Invalid -record-format %q: must be raw or pcap", *recordFormatFlag)
+	}
+	config.recordMaxBytes = *recordMaxBytesFlag
+	config.requireOrigin = *requireOriginFlag
+	config.requireSubproto = *requireSubprotocolFlag
+	config.trustForwarded = *trustForwardedFlag
+	config.fallbackTarget = *fallbackTargetFlag
+	config.resolveEach = *resolveEachFlag
+	if *allowedPortsFlag != "" {
+		allowedPorts, err := parsePortRanges(*allowedPortsFlag)
+		if err != nil {
+			logger.Fatalf("Invalid -allowed-ports: %v", err)
+		}
+		config.allowedPorts = allowedPorts
+	}
+	if *exposeTargetFlag != "" {
+		exposeTargetTo, err := parsePrefixList(*exposeTargetFlag)
+		if err != nil {
+			logger.Fatalf("Invalid -expose-target: %v", err)
+		}
+		config.exposeTargetTo = exposeTargetTo
+	}
+	config.targetWS = *targetWSFlag
+	targetWSHeader, targetWSForward, err := parseTargetWSHeaders(targetWSHeaderFlags)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	config.targetWSHeader = targetWSHeader
+	config.targetWSForward = targetWSForward
+	if *targetWSSubprotocolsFlag && config.targetWS == "" {
+		logger.Fatal("-target-ws-subprotocols requires -target-ws")
+	}
+	config.targetWSProtos = *targetWSSubprotocolsFlag
+	if *relayRespHeadersFlag != "" {
+		if config.targetWS == "" {
+			logger.Fatal("-relay-response-headers requires -target-ws")
+		}
+		if config.relayRespHeaders, err = parseRelayHeaders(*relayRespHeadersFlag); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	config.eagerDial = *eagerDialFlag
+	if *connectBudgetFlag < 0 {
+		logger.Fatal("-connect-budget must not be negative")
+	}
+	config.connectBudget = *connectBudgetFlag
+	if *compressionLevelFlag < 0 || *compressionLevelFlag > 9 {
+		logger.Fatal("-compression-level must be between 0 and 9")
+	}
+	config.compression = *compressionFlag
+	if *wsExtensionsFlag != "" {
+		exts, err := parseExtensions(*wsExtensionsFlag)
+		if err != nil {
+			logger.Fatalf("-ws-extensions: %v", err)
+		}
+		if slices.Contains(exts, "permessage-deflate") {
+			config.compression = true
+		} else if config.compression {
+			logger.Fatal("-compression needs permessage-deflate in -ws-extensions")
+		}
+		config.wsExtensions = exts
+	}
+	config.halfClose = *halfCloseFlag
+	config.drainTimeout = *drainTimeoutFlag
+	config.drainDeadline = *drainDeadlineFlag
+	if config.drainDeadline == 0 {
+		config.drainDeadline = config.drainTimeout + drainDeadlineAfterTimeout
+	} else if config.drainDeadline < config.drainTimeout {
+		logger.Fatal("-drain-deadline must not be shorter than -drain-timeout")
+	}
+	if !validCloseCode(*shutdownCloseCodeFlag) {
+		logger.Fatalf("Invalid -shutdown-close-code %d", *shutdownCloseCodeFlag)
+	}
+	config.shutdownCloseCode = *shutdownCloseCodeFlag
+	config.handshakeTimeout = *handshakeTimeoutFlag
+	config.pingIdle = *pingIdleFlag
+	config.pongTimeout = *pongTimeoutFlag
+	config.idleTimeout = *idleTimeoutFlag
+	config.tcpReadDeadline = *tcpReadDeadlineFlag
+	config.wsReadDeadline = *wsReadDeadlineFlag
+	config.idleIgnoresCtrl = *idleIgnoresControlFlag
+	config.compressionLevel = *compressionLevelFlag
+	if *tcpReadBufferFlag <= 0 {
+		logger.Fatal("-tcp-read-buffer must be positive")
+	}
+	config.tcpReadBuffer = *tcpReadBufferFlag
+	config.tcpNoDelay = *tcpNoDelayFlag
+	if *frameDebugFlag && *targetWSFlag != "" {
+		logger.Fatal("-frame-debug only works with TCP targets, not -target-ws")
+	}
+	config.frameDebug = *frameDebugFlag
+	if *trimTrailingNullFlag && *targetWSFlag != "" {
+		logger.Fatal("-trim-trailing-null only works with TCP targets, not -target-ws")
+	}
+	config.trimTrailingNull = *trimTrailingNullFlag
+	if *controlChannelFlag && *targetWSFlag != "" {
+		logger.Fatal("-control-channel only works with TCP targets, not -target-ws")
+	}
+	config.controlChannel = *controlChannelFlag
+	if *coalesceFlag < 0 {
+		logger.Fatal("-coalesce must not be negative")
+	}
+	config.coalesce = *coalesceFlag
+	if *wsBufferSizeFlag < 0 {
+		logger.Fatal("-ws-buffer-size must not be negative")
+	}
+	config.wsBufferSize = *wsBufferSizeFlag
+	if *maxFrameSizeFlag < 0 {
+		logger.Fatal("-max-frame-size must not be negative")
+	}
+	config.maxFrameSize = *maxFrameSizeFlag
+	if *maxBufferBytesFlag > 0 && !unsentBytesSupported {
+		logger.Fatal("-max-buffer-bytes is only supported on Linux")
+	}
+	config.maxBufferBytes = *maxBufferBytesFlag
+	if *dscpFlag != "" {
+		if config.dscp, err = parseDSCP(*dscpFlag); err != nil {
+			logger.Fatal(err)
+		}
+		if !dscpSupported {
+			logger.Println("WARNING: -dscp is not supported on this platform and has no effect")
+		}
+	}
+	config.sessionTickets = *sessionTicketsFlag
+	config.ticketRotate = *ticketRotateFlag
+	config.sessionCacheSize = *sessionCacheSizeFlag
+	config.clientCAFile = *clientCAFlag
+	config.clientCRL = *clientCRLFlag
+	config.ocspStaple = *ocspStapleFlag
+	if *alpnFlag != "" {
+		alpn, err := parseALPN(*alpnFlag)
+		if err != nil {
+			logger.Fatalf("-tls-alpn: %v", err)
+		}
+		config.alpn = alpn
+	}
+	routes, err := parseRoutes(routeFlags)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	config.routes = routes
 	listenAddr := flag.Arg(0)
 	config.targetAddr = flag.Arg(1)
+	sources := 0
+	for _, v := range []string{config.targetAddr, *targetSRVFlag, *targetTemplateFlag, *targetWSFlag} {
+		if v != "" {
+			sources++
+		}
+	}
+	if *echoFlag {
+		sources++
+	}
+	switch {
+	case sources > 1:
+		logger.Fatal("Give only one of a target address, -target-srv, -target-template, -target-ws or -echo")
+	case config.targetAddr != "":
+		config.resolver = staticResolver(config.targetAddr)
+	case *targetSRVFlag != "":
+		config.resolver = newSRVResolver(*targetSRVFlag)
+	case *targetTemplateFlag != "":
+		tmpl, err := parseTargetTemplate(*targetTemplateFlag)
+		if err != nil {
+			logger.Fatalf("-target-template: %v", err)
+		}
+		config.resolver = tmpl
+	}
 
 	// Validate arguments
-	if listenAddr == "" || config.targetAddr == "" {
+	config.echo = *echoFlag
+	if listenAddr == "" || (config.resolver == nil && config.targetWS == "" && !config.echo && len(config.routes) == 0) {
 		logger.Fatal("Usage: websockify-go <listen_addr> <target_addr> [options]")
 	}
+	if !socketActivated() {
+		if listenAddr, err = normalizeListenAddr(listenAddr); err != nil {
+			logger.Fatal(err)
+		}
+	}
 
 	// Web server setup
-	if *webDir != "" {
+	if *webDir != "" && *embeddedWebFlag {
+		logger.Fatal("-web and -embedded-web are mutually exclusive")
+	}
+	if *webDir != "" || *embeddedWebFlag {
 		config.webServer = true
-		fileHandler = http.FileServer(http.Dir(*webDir))
+		config.webFallback = *webFallbackFlag
+		if *embeddedWebFlag {
+			files, err := embeddedWeb()
+			if err != nil {
+				logger.Fatalf("-embedded-web: %v", err)
+			}
+			fileHandler = http.FileServer(http.FS(files))
+		} else {
+			fileHandler = http.FileServer(http.Dir(*webDir))
+		}
+		if prefix := strings.TrimSuffix(*webPrefixFlag, "/"); prefix != "" {
+			if !strings.HasPrefix(prefix, "/") {
+				logger.Fatal("-web-prefix must start with /")
+			}
+			fileHandler = http.StripPrefix(prefix, fileHandler)
+			config.webPrefix = prefix
+		}
+	}
+	if *rootRedirectFlag != "" {
+		u, err := url.Parse(*rootRedirectFlag)
+		if err != nil || (!u.IsAbs() && !strings.HasPrefix(u.Path, "/")) || u.Path == "/" && u.Host == "" {
+			logger.Fatalf("Invalid -root-redirect %q: need an absolute URL or a path other than /", *rootRedirectFlag)
+		}
+		config.rootRedirect = *rootRedirectFlag
+	}
+	if *adminAuthFlag != "" {
+		creds, err := parseCredentials(*adminAuthFlag)
+		if err != nil {
+			logger.Fatalf("Invalid -admin-auth: %v", err)
+		}
+		config.adminAuth = &creds
+	}
+	if recentLogs != nil && config.adminAuth == nil {
+		logger.Fatal("-log-buffer requires -admin-auth")
+	}
+	if *adminSessionsFlag && config.adminAuth == nil {
+		logger.Fatal("-admin-sessions requires -admin-auth")
+	}
+	if *webIndexFlag {
+		if !config.webServer {
+			logger.Fatal("-web-index requires -web or -embedded-web")
+		}
+		indexPage = http.HandlerFunc(indexHandler)
+		if config.adminAuth != nil {
+			indexPage = requireAuth(*config.adminAuth, "websockify admin", indexPage)
+		}
+	}
+
+	config.health = *healthFlag || *healthCheckTargetFlag
+	config.healthCheckTarget = *healthCheckTargetFlag
+	if config.healthCheckTarget {
+		if config.targetAddr == "" {
+			logger.Fatal("-healthcheck-target requires a target address")
+		}
+		health.target = config.targetAddr
+	}
+
+	if err := validateConfig(listenAddr, *cert, *key, *webDir); err != nil {
+		logger.Fatalf("Invalid configuration: %v", err)
+	}
+	if *failClosedFlag {
+		if err := checkStaticTargets(); err != nil {
+			logger.Fatalf("Refusing to start: %v", err)
+		}
+	}
+	if *checkFlag {
+		logger.Println("Configuration OK")
+		return
+	}
+
+	stopProfiling, err := startProfiling(*cpuProfileFlag, *memProfileFlag)
+	if err != nil {
+		logger.Fatal(err)
 	}
+	defer stopProfiling()
 
 	// Log server settings
-	sslLog := " - No SSL/TLS support (no cert file)"
-	if *cert != "" && *key != "" {
-		sslLog = " - SSL/TLS support"
+	logSettings(listenAddr, tlsRequested(*cert, *key))
+	if config.frameDebug {
+		logger.Println("WARNING: -frame-debug is on; only the frame-debug test client can talk to this server")
+	}
+	if config.echo {
+		logger.Println("WARNING: -echo is on; this is a testing mode and no target is ever dialed")
+	}
+	if config.trimTrailingNull {
+		logger.Println("WARNING: -trim-trailing-null is on; client data that legitimately ends in NUL bytes will be corrupted")
+	}
+
+	// Register handlers
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ws)
+	for _, rt := range config.routes {
+		mux.Handle(rt.path, newProxyHandler(proxyRoute{name: rt.path, resolver: staticResolver(rt.target), subprotocols: rt.subprotocols}))
+	}
+	if config.health {
+		mux.HandleFunc("/healthz", healthHandler)
+		mux.HandleFunc("/livez", livezHandler)
+		mux.HandleFunc("/readyz", readyzHandler)
+	}
+	if recentLogs != nil {
+		mux.Handle("/admin/logs", requireAuth(*config.adminAuth, "websockify admin", http.HandlerFunc(logsHandler)))
+	}
+	if *adminSessionsFlag {
+		mux.Handle("GET /admin/sessions", requireAuth(*config.adminAuth, "websockify admin", http.HandlerFunc(listSessionsHandler)))
+		mux.Handle("DELETE /admin/sessions/{id}", requireAuth(*config.adminAuth, "websockify admin", http.HandlerFunc(deleteSessionHandler)))
+	}
+	if *testPageFlag {
+		var page http.Handler = http.HandlerFunc(testPageHandler)
+		if config.adminAuth != nil {
+			page = requireAuth(*config.adminAuth, "websockify admin", page)
+		}
+		mux.Handle(testPagePath, page)
 	}
-	logger.Printf("WebSocket server settings:\n"+
-		" - Listen on %s\n"+
-		sslLog+
-		" - Proxying to %s\n", listenAddr, config.targetAddr)
 
-	// Register handler
-	http.HandleFunc("/", ws)
+	var handler http.Handler = mux
+	if *enableCORSFlag {
+		handler = corsPreflight(handler)
+	}
+	server := &http.Server{
+		Handler:        handler,
+		MaxHeaderBytes: *maxHeaderBytesFlag,
+		// Bound the request-header half of the handshake; the upgrader's
+		// HandshakeTimeout bounds writing the response.
+		ReadHeaderTimeout: config.handshakeTimeout,
+	}
 
-	// Start server
-	if *cert != "" && *key != "" {
-		logger.Printf("Starting secure WebSocket server (wss://) on %s", listenAddr)
-		if err := http.ListenAndServeTLS(listenAddr, *cert, *key, nil); err != nil {
+	// Start server, preferring a socket passed by systemd
+	ln, err := activationListener()
+	if err != nil {
+		logger.Fatalf("Error using socket-activated listener: %v", err)
+	}
+	if ln != nil {
+		listenAddr = ln.Addr().String()
+		logger.Printf("Using socket-activated listener on %s", listenAddr)
+	} else if ln, err = listen(listenAddr); err != nil {
+		fatalBindError(listenAddr, err)
+	}
+	if *acceptProxyFlag {
+		ln = newProxyProtoListener(ln)
+	}
+	listeners := newListenerGroup()
+	if tlsRequested(*cert, *key) {
+		tlsConfig, err := newTLSConfig(*cert, *key)
+		if err != nil {
 			logger.Fatal(err)
 		}
+		logger.Printf("Starting secure WebSocket server (wss://) on %s", listenAddr)
+		listeners.serve("WebSocket", true, server, tls.NewListener(ln, tlsConfig))
 	} else {
 		logger.Printf("Starting WebSocket server (ws://) on %s", listenAddr)
-		if err := http.ListenAndServe(listenAddr, nil); err != nil {
+		listeners.serve("WebSocket", true, server, ln)
+	}
+	if metricsHandler != nil {
+		mln, err := net.Listen("tcp", *metricsAddrFlag)
+		if err != nil {
+			fatalBindError(*metricsAddrFlag, err)
+		}
+		if *metricsAuthFlag == "" {
+			logger.Printf("Serving metrics on http://%s/metrics (keep this address private or use -metrics-auth)", mln.Addr())
+		} else {
+			logger.Printf("Serving metrics on http://%s/metrics", mln.Addr())
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler)
+		listeners.serve("metrics", false, &http.Server{Handler: mux}, mln)
+	}
+	if *pprofAddrFlag != "" {
+		pln, err := net.Listen("tcp", *pprofAddrFlag)
+		if err != nil {
+			fatalBindError(*pprofAddrFlag, err)
+		}
+		logger.Printf("Serving pprof on http://%s/debug/pprof/ (keep this address private)", pln.Addr())
+		listeners.serve("pprof", false, &http.Server{Handler: newPprofMux()}, pln)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan error, 1)
+	go func() { stopped <- listeners.wait() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			stopProfiling()
 			logger.Fatal(err)
 		}
+	case sig := <-stop:
+		if drain(sig, listeners) {
+			// os.Exit skips the deferred flushes
+			stopProfiling()
+			if tracer != nil {
+				tracer.shutdown()
+			}
+			os.Exit(exitForcedShutdown)
+		}
+	case <-runOnceDone:
+		logger.Println("Run once! Exiting...")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		listeners.shutdown(ctx)
 	}
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testLog collects log output so tests can check what was logged.
+type testLog struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *testLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// setupTest gives the test the configuration main sets up by default and
+// a fresh log, restoring the previous state afterwards.
+func setupTest(t testing.TB) *testLog {
+	t.Helper()
+	savedConfig, savedLogger, savedVerbose := config, logger, verboseLogger
+	out := &testLog{}
+	t.Cleanup(func() {
+		// The TCP to WebSocket goroutine outlives proxy; let it finish
+		// reading the configuration before it is replaced
+		waitFor(t, "TCP sessions to finish", func() bool {
+			log := out.String()
+			return strings.Count(log, "connected to target") == strings.Count(log, "Closed TCP to WS")
+		})
+		config, logger, verboseLogger = savedConfig, savedLogger, savedVerbose
+		shouldExit.Store(false)
+		runOnceDone = make(chan struct{})
+	})
+	config = appConfig{
+		tcpReadBuffer:    1024,
+		tcpNoDelay:       true,
+		handshakeTimeout: 5 * time.Second,
+		compressionLevel: 3,
+	}
+	// The pool may hold buffers of another test's -tcp-read-buffer
+	tcpBufferPool = sync.Pool{New: tcpBufferPool.New}
+	logger = log.New(out, "", 0)
+	verboseLogger = log.New(out, "", 0)
+	return out
+}
+
+// waitFor polls cond until it holds, failing the test after 5 seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// pipeTarget makes the default route dial an in-memory target served by
+// handle, and returns a channel receiving the target side of each session.
+func pipeTarget(t testing.TB, handle func(net.Conn)) <-chan net.Conn {
+	t.Helper()
+	conns := make(chan net.Conn, 16)
+	config.resolver = staticResolver("target.test:5900")
+	config.dialContext = func(ctx context.Context, target string) (net.Conn, error) {
+		proxySide, targetSide := net.Pipe()
+		conns <- targetSide
+		if handle != nil {
+			go handle(targetSide)
+		}
+		return proxySide, nil
+	}
+	return conns
+}
+
+// startProxy serves ws on a local test server.
+func startProxy(t testing.TB) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(ws))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dialProxy opens a WebSocket client connection to srv.
+func dialProxy(t testing.TB, srv *httptest.Server) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+	c, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Cleanup(func() { c.Close() })
+	}
+	return c, resp, err
+}
+
+func TestRunOnce(t *testing.T) {
+	setupTest(t)
+	config.runOnce = true
+	targets := pipeTarget(t, nil)
+	srv := startProxy(t)
+
+	client, _, err := dialProxy(t, srv)
+	if err != nil {
+		t.Fatalf("first upgrade: %v", err)
+	}
+	target := <-targets
+
+	// The session works
+	go target.Write([]byte("hello"))
+	if _, msg, err := client.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("ReadMessage = %q, %v; want hello", msg, err)
+	}
+
+	if _, resp, err := dialProxy(t, srv); err == nil {
+		t.Fatal("second upgrade succeeded")
+	} else if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("second upgrade: got %v, want 503", err)
+	}
+	select {
+	case <-runOnceDone:
+		t.Fatal("runOnceDone closed while the session is open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(targets) != 0 {
+		t.Fatal("the second upgrade dialed a target")
+	}
+
+	client.Close()
+	select {
+	case <-runOnceDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runOnceDone not closed after the session ended")
+	}
+	// The session was torn down before the signal
+	if n := sessions.count(); n != 0 {
+		t.Errorf("%d sessions registered after runOnceDone", n)
+	}
+	if _, err := target.Write([]byte("x")); err == nil {
+		t.Error("target connection still open after runOnceDone")
+	}
+}
+
+// TestTargetWSDefaultRouteOnly checks that -target-ws doesn't take over
+// -route paths, which keep proxying to their own TCP targets.
+func TestTargetWSDefaultRouteOnly(t *testing.T) {
+	setupTest(t)
+	targets := pipeTarget(t, nil)
+	config.resolver = nil
+	// Nothing listens there; a session sent to it would fail
+	config.targetWS = "ws://127.0.0.1:1/"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ws)
+	mux.Handle("/vnc", newProxyHandler(proxyRoute{name: "/vnc", resolver: staticResolver("target.test:5900"), subprotocols: defaultSubprotocols}))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/vnc", nil)
+	if err != nil {
+		t.Fatalf("upgrade on the route: %v", err)
+	}
+	defer client.Close()
+	var target net.Conn
+	select {
+	case target = <-targets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the route didn't dial its TCP target")
+	}
+	go target.Write([]byte("hello"))
+	if _, msg, err := client.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("ReadMessage = %q, %v; want hello", msg, err)
+	}
+}
+
+// TestDirectionalBufferSizes checks that -tcp-read-buffer caps the messages
+// sent to the client while client messages reach the target whole, however
+// large.
+func TestDirectionalBufferSizes(t *testing.T) {
+	setupTest(t)
+	config.tcpReadBuffer = 16
+	targets := pipeTarget(t, nil)
+	client, _, err := dialProxy(t, startProxy(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := <-targets
+
+	// TCP to WebSocket: one 64-byte write arrives in messages of at most
+	// 16 bytes
+	down := bytes.Repeat([]byte("d"), 64)
+	go target.Write(down)
+	var got []byte
+	for len(got) < len(down) {
+		_, msg, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg) > config.tcpReadBuffer {
+			t.Errorf("client got a %d-byte message, want at most %d", len(msg), config.tcpReadBuffer)
+		}
+		got = append(got, msg...)
+	}
+	if !bytes.Equal(got, down) {
+		t.Errorf("client got %q, want %q", got, down)
+	}
+
+	// WebSocket to TCP: a message larger than -tcp-read-buffer is written
+	// to the target in one piece
+	up := bytes.Repeat([]byte("u"), 1000)
+	if err := client.WriteMessage(websocket.BinaryMessage, up); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	n, err := target.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], up) {
+		t.Errorf("target read %d bytes, %v; want the 1000-byte message whole", n, err)
+	}
+}
+
+// TestBeforeUpgrade checks that the hook sees every handshake before the
+// upgrade, and that refusing one sends the hook's response and dials no
+// target.
+func TestBeforeUpgrade(t *testing.T) {
+	setupTest(t)
+	targets := pipeTarget(t, nil)
+	config.beforeUpgrade = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Auth-User") == "" {
+			http.Error(w, "no user", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	srv := startProxy(t)
+
+	if _, resp, err := dialProxy(t, srv); err == nil {
+		t.Fatal("upgrade without X-Auth-User succeeded")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("upgrade without X-Auth-User: got %v, want the hook's 401", err)
+	}
+	if len(targets) != 0 {
+		t.Fatal("a refused upgrade dialed a target")
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+	client, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Auth-User": {"alice"}})
+	if err != nil {
+		t.Fatalf("upgrade with X-Auth-User: %v", err)
+	}
+	defer client.Close()
+	<-targets
+}
@@ -0,0 +1,69 @@
+package main
+
+import "time"
+
+// metricsSink receives the proxy's instrumentation events. Every exporter
+// (StatsD and Prometheus) implements it, and each enabled one is added to
+// metrics so they can run side by side. Events carry the name of the route
+// the session came in on: the -route path, or defaultRouteName.
+type metricsSink interface {
+	// sessionStarted is called once a session is connected to its target.
+	sessionStarted(route string)
+	// sessionEnded is called when a connected session ends, with why it
+	// ended (one of the cause constants), its duration and the bytes
+	// proxied in each direction.
+	sessionEnded(route, cause string, d time.Duration, toClient, toTarget int64)
+	// dialFailed is called for every failed attempt to find or connect to
+	// a target.
+	dialFailed(route string)
+	// rejected is called for every request refused by policy before the
+	// upgrade, with why (one of the reject constants).
+	rejected(route, reason string)
+}
+
+// multiSink fans events out to every enabled exporter. The zero value
+// drops them.
+type multiSink []metricsSink
+
+var metrics multiSink
+
+func (m multiSink) sessionStarted(route string) {
+	for _, s := range m {
+		s.sessionStarted(route)
+	}
+}
+
+func (m multiSink) sessionEnded(route, cause string, d time.Duration, toClient, toTarget int64) {
+	for _, s := range m {
+		s.sessionEnded(route, cause, d, toClient, toTarget)
+	}
+}
+
+func (m multiSink) dialFailed(route string) {
+	for _, s := range m {
+		s.dialFailed(route)
+	}
+}
+
+func (m multiSink) rejected(route, reason string) {
+	for _, s := range m {
+		s.rejected(route, reason)
+	}
+}
+
+// trackSession reports sess to the metrics sinks as started and returns a
+// function that logs its summary, reports it as ended and exports its
+// trace span.
+func trackSession(sess *session) func() {
+	metrics.sessionStarted(sess.route)
+	return func() {
+		d := time.Since(sess.started)
+		cause, toClient, toTarget := sess.closeCause(), sess.toClientBytes.Load(), sess.toTargetBytes.Load()
+		logger.Printf("Session %s from %s%s to %s ended by %s after %v (%d bytes to client, %d bytes to target; %s)",
+			sess.id, sess.clientIP, forServerName(sess.serverName), sess.targetAddr(), cause, d.Round(time.Millisecond), toClient, toTarget, sess.firstByteLatencies())
+		metrics.sessionEnded(sess.route, cause, d, toClient, toTarget)
+		if tracer != nil {
+			tracer.sessionSpan(sess, cause, sess.started.Add(d))
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ocspRefreshInterval is how often the -ocsp-staple file is re-read, so a
+// cron job or certbot hook refreshing it is picked up without a restart.
+const ocspRefreshInterval = time.Hour
+
+// ocspMinRefresh is the shortest wait between re-reads as the staple's
+// nextUpdate nears.
+const ocspMinRefresh = time.Minute
+
+// stapler serves the certificate with the OCSP response from -ocsp-staple
+// attached.
+type stapler struct {
+	file    string
+	base    tls.Certificate
+	current atomic.Pointer[staple]
+}
+
+// staple is a certificate with its OCSP response attached, and when that
+// response expires: its nextUpdate, zero if none.
+type staple struct {
+	cert    *tls.Certificate
+	expires time.Time
+}
+
+// newStapler loads the OCSP response for cert from file, failing if it
+// can't be used, and keeps re-reading it every ocspRefreshInterval, or
+// sooner as its nextUpdate nears.
+func newStapler(file string, cert tls.Certificate) (*stapler, error) {
+	s := &stapler{file: file, base: cert}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.refreshLoop()
+	return s, nil
+}
+
+// load reads and checks the response file and starts stapling it.
+func (s *stapler) load() error {
+	der, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	nextUpdate, err := checkOCSPResponse(der, s.base.Leaf.SerialNumber, time.Now())
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.file, err)
+	}
+	cert := s.base
+	cert.OCSPStaple = der
+	s.current.Store(&staple{cert: &cert, expires: nextUpdate})
+	return nil
+}
+
+// refreshWait returns how long until the response file should next be
+// re-read: ocspRefreshInterval, or half the time left until the current
+// staple expires if that is sooner, so a refreshed file is picked up before
+// then.
+func (s *stapler) refreshWait() time.Duration {
+	wait := ocspRefreshInterval
+	if st := s.current.Load(); st != nil && !st.expires.IsZero() {
+		wait = min(wait, max(time.Until(st.expires)/2, ocspMinRefresh))
+	}
+	return wait
+}
+
+func (s *stapler) refreshLoop() {
+	for {
+		time.Sleep(s.refreshWait())
+		err := s.load()
+		if err == nil {
+			verboseLogger.Printf("Reloaded OCSP staple %s", s.file)
+			continue
+		}
+		// Keep the old staple while it is valid; getCertificate stops
+		// stapling it once it expires
+		if st := s.current.Load(); st.cert.OCSPStaple != nil && st.expired(time.Now()) {
+			logger.Printf("Cannot reload OCSP staple, dropping the expired one: %v", err)
+			s.current.Store(&staple{cert: &s.base})
+		} else {
+			logger.Printf("Cannot reload OCSP staple, keeping the current one: %v", err)
+		}
+	}
+}
+
+// expired reports whether the staple's response is past its nextUpdate.
+func (st *staple) expired(now time.Time) bool {
+	return !st.expires.IsZero() && now.After(st.expires)
+}
+
+// getCertificate returns the certificate with the current staple, or
+// without one once it has expired, since strict clients reject the
+// handshake over an expired OCSP response.
+func (s *stapler) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	st := s.current.Load()
+	if st.expired(time.Now()) {
+		return &s.base, nil
+	}
+	return st.cert, nil
+}
+
+// The subset of the RFC 6960 OCSP response structures checkOCSPResponse
+// needs.
+type ocspResponse struct {
+	Status asn1.Enumerated
+	Bytes  struct {
+		Type     asn1.ObjectIdentifier
+		Response []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	Data   ocspResponseData
+	SigAlg asn1.RawValue
+	Sig    asn1.BitString
+	Certs  asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,explicit,default:0,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  asn1.RawValue `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID struct {
+		HashAlgorithm  asn1.RawValue
+		IssuerNameHash []byte
+		IssuerKeyHash  []byte
+		SerialNumber   *big.Int
+	}
+	CertStatus asn1.RawValue
+	ThisUpdate time.Time     `asn1:"generalized"`
+	NextUpdate time.Time     `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions asn1.RawValue `asn1:"explicit,tag:1,optional"`
+}
+
+// ocspBasicOID identifies id-pkix-ocsp-basic responses, the only kind
+// responders send.
+var ocspBasicOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// checkOCSPResponse checks that the DER response says the certificate with
+// serial is good and is current at now, and returns its nextUpdate (zero if
+// the responder gave none). The signature is left to the clients, which
+// verify it anyway.
+func checkOCSPResponse(der []byte, serial *big.Int, now time.Time) (time.Time, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return time.Time{}, fmt.Errorf("not a DER OCSP response: %w", err)
+	}
+	if resp.Status != 0 {
+		return time.Time{}, fmt.Errorf("OCSP responder returned status %d", resp.Status)
+	}
+	if !resp.Bytes.Type.Equal(ocspBasicOID) {
+		return time.Time{}, errors.New("unsupported OCSP response type")
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Bytes.Response, &basic); err != nil {
+		return time.Time{}, fmt.Errorf("malformed OCSP response: %w", err)
+	}
+	for _, single := range basic.Data.Responses {
+		if single.CertID.SerialNumber == nil || single.CertID.SerialNumber.Cmp(serial) != 0 {
+			continue
+		}
+		switch single.CertStatus.Tag {
+		case 0: // good
+		case 1:
+			return time.Time{}, errors.New("OCSP response says the certificate is revoked")
+		default:
+			return time.Time{}, errors.New("OCSP responder does not know the certificate")
+		}
+		if now.Before(single.ThisUpdate) {
+			return time.Time{}, fmt.Errorf("OCSP response is not valid before %v", single.ThisUpdate)
+		}
+		if !single.NextUpdate.IsZero() && now.After(single.NextUpdate) {
+			return time.Time{}, fmt.Errorf("OCSP response expired at %v", single.NextUpdate)
+		}
+		return single.NextUpdate, nil
+	}
+	return time.Time{}, errors.New("OCSP response is for a different certificate")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+// TestStaplerDropsExpiredStaple checks that a staple past its nextUpdate is
+// never served, and that the refresh is scheduled before it.
+func TestStaplerDropsExpiredStaple(t *testing.T) {
+	s := &stapler{}
+	cert := tls.Certificate{OCSPStaple: []byte("response")}
+	s.current.Store(&staple{cert: &cert, expires: time.Now().Add(10 * time.Minute)})
+	if got, _ := s.getCertificate(nil); got.OCSPStaple == nil {
+		t.Error("valid staple not served")
+	}
+	if wait := s.refreshWait(); wait > 5*time.Minute {
+		t.Errorf("refresh in %v, want it well before the staple expires", wait)
+	}
+
+	s.current.Store(&staple{cert: &cert, expires: time.Now().Add(-time.Second)})
+	if got, _ := s.getCertificate(nil); got.OCSPStaple != nil {
+		t.Error("expired staple served")
+	}
+}
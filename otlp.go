@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLP export tuning: spans are sent in batches of up to otlpBatchSize, at
+// least every otlpFlushInterval, and dropped if more than otlpQueueSize are
+// waiting.
+const (
+	otlpBatchSize     = 100
+	otlpFlushInterval = 5 * time.Second
+	otlpQueueSize     = 2048
+	otlpTimeout       = 10 * time.Second
+)
+
+// otlpExporter sends one span per session to an OpenTelemetry collector
+// using OTLP/HTTP with JSON encoding, which needs no OpenTelemetry
+// libraries. A session whose handshake carried a W3C traceparent header
+// becomes a child of that trace, so it lines up with the client's traces.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+	spans    chan map[string]any
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// tracer is the -otlp-endpoint exporter, or nil when tracing is off.
+var tracer *otlpExporter
+
+// newOTLPExporter starts exporting to endpoint. A URL without a path gets
+// the standard /v1/traces.
+func newOTLPExporter(endpoint string) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q, use http or https", u.Scheme)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	e := &otlpExporter{
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: otlpTimeout},
+		spans:    make(chan map[string]any, otlpQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// sessionSpan queues the span of a finished session.
+func (e *otlpExporter) sessionSpan(sess *session, cause string, end time.Time) {
+	traceID, parentID := parseTraceParent(sess.traceParent)
+	if traceID == "" {
+		traceID = randomHex(16)
+	}
+	status := 1 // STATUS_CODE_OK
+	if cause == causeError {
+		status = 2 // STATUS_CODE_ERROR
+	}
+	span := map[string]any{
+		"traceId":           traceID,
+		"spanId":            randomHex(8),
+		"name":              "websocket session",
+		"kind":              2, // SPAN_KIND_SERVER
+		"startTimeUnixNano": strconv.FormatInt(sess.started.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes": []map[string]any{
+			otlpString("client.address", sess.clientIP),
+			otlpString("websockify.session_id", sess.id),
+			otlpString("websockify.route", sess.route),
+			otlpString("websockify.target", sess.targetAddr()),
+			otlpString("websockify.close_cause", cause),
+			otlpInt("websockify.bytes_to_client", sess.toClientBytes.Load()),
+			otlpInt("websockify.bytes_to_target", sess.toTargetBytes.Load()),
+		},
+		"status": map[string]any{"code": status},
+	}
+	if parentID != "" {
+		span["parentSpanId"] = parentID
+	}
+	select {
+	case e.spans <- span:
+	default:
+		verboseLogger.Printf("OTLP queue full, dropping span of session %s", sess.id)
+	}
+}
+
+// shutdown sends the spans queued so far. Spans of sessions ending later
+// are dropped.
+func (e *otlpExporter) shutdown() {
+	close(e.stop)
+	<-e.done
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	var batch []map[string]any
+	for {
+		select {
+		case span := <-e.spans:
+			if batch = append(batch, span); len(batch) >= otlpBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case <-e.stop:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			e.send(batch)
+			return
+		}
+	}
+}
+
+// send posts one ExportTraceServiceRequest.
+func (e *otlpExporter) send(spans []map[string]any) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": []map[string]any{otlpString("service.name", "websockify")},
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": "websockify"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		logger.Printf("Error encoding OTLP spans: %v", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Printf("Error exporting %d OTLP spans: %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logger.Printf("Error exporting %d OTLP spans: collector answered %s", len(spans), resp.Status)
+	}
+}
+
+// parseTraceParent returns the trace and parent span IDs of a W3C
+// traceparent header, or empty strings if it is missing or malformed.
+func parseTraceParent(v string) (traceID, spanID string) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", ""
+	}
+	for _, id := range parts[1:3] {
+		if _, err := hex.DecodeString(id); err != nil || strings.Trim(id, "0") == "" {
+			return "", ""
+		}
+	}
+	return strings.ToLower(parts[1]), strings.ToLower(parts[2])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func otlpString(key, value string) map[string]any {
+	return map[string]any{"key": key, "value": map[string]any{"stringValue": value}}
+}
+
+func otlpInt(key string, value int64) map[string]any {
+	return map[string]any{"key": key, "value": map[string]any{"intValue": strconv.FormatInt(value, 10)}}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const unsentBytesSupported = true
+
+// unsentBytes returns how many bytes written to conn the kernel still holds
+// in the socket's send queue, not yet acknowledged by the peer (TIOCOUTQ).
+func unsentBytes(conn net.Conn) (int, error) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("not a socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n int32
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&n)))
+	}); err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
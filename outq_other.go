@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const unsentBytesSupported = false
+
+func unsentBytes(conn net.Conn) (int, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Addresses of the synthetic TCP connection pcap captures show. The real
+// peers may be IPv6, host names or, with -target-ws, not TCP at all, and
+// the capture should not leak them anyway.
+var (
+	pcapClientIP = [4]byte{10, 0, 0, 1}
+	pcapTargetIP = [4]byte{10, 0, 0, 2}
+)
+
+const (
+	pcapClientPort = 49152
+	// pcapDefaultTargetPort is used when the target has no TCP port, so
+	// Wireshark still picks its VNC dissector.
+	pcapDefaultTargetPort = 5900
+
+	linktypeRaw    = 101 // LINKTYPE_RAW: packets start with the IP header
+	pcapMaxPayload = 65535 - 20 - 20
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapWriter writes a session's traffic as a pcap capture of one TCP
+// connection between pcapClientIP and pcapTargetIP, so Wireshark can
+// reassemble the streams and dissect the protocol. Each chunk the proxy
+// forwarded becomes a packet stamped with when it was forwarded.
+type pcapWriter struct {
+	w          io.Writer
+	targetPort uint16
+	started    bool
+	// seq is the next sequence number of the client and of the target.
+	seq [2]uint32
+}
+
+// newPcapWriter writes the pcap file header to w.
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4) // microsecond timestamps
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535) // snaplen
+	binary.LittleEndian.PutUint32(hdr[20:], linktypeRaw)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: w, targetPort: pcapDefaultTargetPort}, nil
+}
+
+// setTarget takes the capture's target port from the host:port target.
+func (p *pcapWriter) setTarget(target string) {
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+			p.targetPort = uint16(n)
+		}
+	}
+}
+
+// write records data as sent in direction, opening the connection with a
+// three-way handshake first.
+func (p *pcapWriter) write(direction string, data []byte) error {
+	if !p.started {
+		p.started = true
+		if err := p.packet(true, tcpSYN, nil); err != nil {
+			return err
+		}
+		if err := p.packet(false, tcpSYN|tcpACK, nil); err != nil {
+			return err
+		}
+		if err := p.packet(true, tcpACK, nil); err != nil {
+			return err
+		}
+	}
+	fromClient := direction == toTarget
+	for len(data) > 0 {
+		n := min(len(data), pcapMaxPayload)
+		if err := p.packet(fromClient, tcpPSH|tcpACK, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// close records both sides closing the connection.
+func (p *pcapWriter) close() error {
+	if !p.started {
+		return nil
+	}
+	if err := p.packet(true, tcpFIN|tcpACK, nil); err != nil {
+		return err
+	}
+	if err := p.packet(false, tcpFIN|tcpACK, nil); err != nil {
+		return err
+	}
+	return p.packet(true, tcpACK, nil)
+}
+
+// packet writes one IPv4 TCP packet from the client or the target and
+// advances that side's sequence number.
+func (p *pcapWriter) packet(fromClient bool, flags byte, payload []byte) error {
+	src, dst := pcapClientIP, pcapTargetIP
+	srcPort, dstPort := uint16(pcapClientPort), p.targetPort
+	self, peer := 0, 1
+	if !fromClient {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		self, peer = 1, 0
+	}
+	pkt := make([]byte, 40+len(payload))
+
+	ip := pkt[:20]
+	ip[0] = 0x45 // IPv4, 20 byte header
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64                                 // TTL
+	ip[9] = 6                                  // TCP
+	copy(ip[12:], src[:])
+	copy(ip[16:], dst[:])
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip))
+
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], p.seq[self])
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], p.seq[peer])
+	}
+	tcp[12] = 5 << 4 // 20 byte header
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	copy(tcp[20:], payload)
+	pseudo := make([]byte, 12, 12+len(tcp))
+	copy(pseudo[0:], src[:])
+	copy(pseudo[4:], dst[:])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], internetChecksum(append(pseudo, tcp...)))
+
+	p.seq[self] += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		p.seq[self]++
+	}
+
+	now := time.Now()
+	var rec [16]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	if _, err := p.w.Write(rec[:]); err != nil {
+		return err
+	}
+	_, err := p.w.Write(pkt)
+	return err
+}
+
+// internetChecksum is the RFC 1071 checksum of b.
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
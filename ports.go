@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of TCP ports.
+type portRange struct {
+	lo, hi int
+}
+
+// portRanges is the parsed value of -allowed-ports.
+type portRanges []portRange
+
+// parsePortRanges parses a comma-separated list of ports and port ranges
+// such as "5900-5999,6080".
+func parsePortRanges(s string) (portRanges, error) {
+	var ranges portRanges
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		loStr, hiStr, isRange := strings.Cut(part, "-")
+		lo, err := parsePort(loStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %q: %w", part, err)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = parsePort(hiStr); err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %w", part, err)
+			}
+			if hi < lo {
+				return nil, fmt.Errorf("invalid port range %q: end before start", part)
+			}
+		}
+		ranges = append(ranges, portRange{lo, hi})
+	}
+	return ranges, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("bad port %q", s)
+	}
+	return port, nil
+}
+
+// allows reports whether the port of the host:port target is in one of the
+// ranges.
+func (p portRanges) allows(target string) bool {
+	_, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	for _, r := range p {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAllowedTargets drops the targets on ports -allowed-ports doesn't
+// permit, logging each one.
+func filterAllowedTargets(targets []string) []string {
+	var allowed []string
+	for _, target := range targets {
+		if config.allowedPorts.allows(target) {
+			allowed = append(allowed, target)
+		} else {
+			logger.Printf("Refusing target %s: port not in -allowed-ports", target)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// newPprofMux returns a mux serving the net/http/pprof handlers. It is only
+// ever served on the separate -pprof-addr listener.
+func newPprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// parseHeaderList parses the comma-separated -forward-headers list into
+// canonical header names.
+func parseHeaderList(v string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	return names, nil
+}
+
+// writeHeaderPreamble writes the -forward-headers of the handshake request
+// to the target as an HTTP-style header block: one "Name: value" line per
+// value, CRLF terminated, and an empty line. Headers the client didn't send
+// are left out, so the block may be just the empty line.
+func writeHeaderPreamble(w io.Writer, r *http.Request) error {
+	header := make(http.Header)
+	for _, name := range config.forwardHeaders {
+		if v := r.Header.Values(name); len(v) > 0 {
+			header[name] = v
+		}
+	}
+	var b strings.Builder
+	header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts the -cpuprofile CPU profile and returns a function
+// that stops it and writes the -memprofile heap profile. Either file name
+// may be empty.
+func startProfiling(cpuFile, memFile string) (func(), error) {
+	var cpu *os.File
+	if cpuFile != "" {
+		f, err := os.Create(cpuFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		cpu = f
+	}
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			cpu.Close()
+			logger.Printf("Wrote CPU profile to %s", cpuFile)
+		}
+		if memFile != "" {
+			if err := writeHeapProfile(memFile); err != nil {
+				logger.Printf("Error writing heap profile: %v", err)
+				return
+			}
+			logger.Printf("Wrote heap profile to %s", memFile)
+		}
+	}, nil
+}
+
+func writeHeapProfile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	runtime.GC() // get up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
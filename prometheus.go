@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promSink keeps the metrics in memory and serves them in the Prometheus
+// text format on the -metrics-addr listener. Series carry the same route,
+// cause and reason labels the StatsD tags do.
+type promSink struct {
+	mu       sync.Mutex
+	counters map[string]map[string]float64 // metric name -> labels -> value
+}
+
+// promMetrics describes the counters, in the order they are served.
+var promMetrics = []struct{ name, help string }{
+	{"websockify_sessions_started_total", "Sessions connected to a target."},
+	{"websockify_sessions_closed_total", "Ended sessions, by who ended them."},
+	{"websockify_session_duration_seconds_total", "Total duration of ended sessions, by who ended them."},
+	{"websockify_bytes_to_client_total", "Bytes sent from the target to the client."},
+	{"websockify_bytes_to_target_total", "Bytes sent from the client to the target."},
+	{"websockify_dial_failures_total", "Failed attempts to find or connect to a target."},
+	{"websockify_rejections_total", "Requests refused by policy before the upgrade, by reason."},
+}
+
+// promLabelEscaper escapes a label value as the text format requires.
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func newPromSink() *promSink {
+	return &promSink{counters: make(map[string]map[string]float64)}
+}
+
+// add adds v to the series of name with the "name", "value" label pairs.
+func (p *promSink) add(name string, v float64, labels ...string) {
+	var b strings.Builder
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + `="` + promLabelEscaper.Replace(labels[i+1]) + `"`)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	series := p.counters[name]
+	if series == nil {
+		series = make(map[string]float64)
+		p.counters[name] = series
+	}
+	series[b.String()] += v
+}
+
+func (p *promSink) sessionStarted(route string) {
+	p.add("websockify_sessions_started_total", 1, "route", route)
+}
+
+func (p *promSink) sessionEnded(route, cause string, d time.Duration, toClient, toTarget int64) {
+	p.add("websockify_sessions_closed_total", 1, "route", route, "cause", cause)
+	p.add("websockify_session_duration_seconds_total", d.Seconds(), "route", route, "cause", cause)
+	p.add("websockify_bytes_to_client_total", float64(toClient), "route", route)
+	p.add("websockify_bytes_to_target_total", float64(toTarget), "route", route)
+}
+
+func (p *promSink) dialFailed(route string) {
+	p.add("websockify_dial_failures_total", 1, "route", route)
+}
+
+func (p *promSink) rejected(route, reason string) {
+	p.add("websockify_rejections_total", 1, "route", route, "reason", reason)
+}
+
+// ServeHTTP writes every series, followed by the number of open sessions.
+func (p *promSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.mu.Lock()
+	for _, m := range promMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		series := p.counters[m.name]
+		labels := make([]string, 0, len(series))
+		for l := range series {
+			labels = append(labels, l)
+		}
+		slices.Sort(labels)
+		for _, l := range labels {
+			fmt.Fprintf(w, "%s{%s} %g\n", m.name, l, series[l])
+		}
+	}
+	p.mu.Unlock()
+	io.WriteString(w, "# HELP websockify_sessions_open Sessions currently running.\n# TYPE websockify_sessions_open gauge\n")
+	fmt.Fprintf(w, "websockify_sessions_open %d\n", sessions.count())
+}
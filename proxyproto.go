@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// proxyHeaderTimeout bounds reading the PROXY protocol header of an accepted
+// connection, so a client that sends nothing can't hold a goroutine.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyProtoSig starts every PROXY protocol v2 header.
+var proxyProtoSig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener reads the PROXY protocol v1 or v2 header a load
+// balancer sends ahead of each connection for -accept-proxy, and reports
+// the client it names as the connection's remote address. Connections
+// without a valid header are dropped. Headers are read off the accept loop,
+// so one slow connection doesn't hold up the others.
+type proxyProtoListener struct {
+	net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // why the accept loop stopped, once conns is closed
+}
+
+func newProxyProtoListener(ln net.Listener) *proxyProtoListener {
+	l := &proxyProtoListener{Listener: ln, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts connections until the listener is closed. Other
+// accept errors, such as running out of file descriptors, are retried with
+// a backoff like net/http's, since http.Server would otherwise spin on the
+// error forever.
+func (l *proxyProtoListener) acceptLoop() {
+	defer close(l.conns)
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.err = err
+				return
+			}
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			logger.Printf("Accept error: %v; retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-l.done:
+				l.err = err
+				return
+			}
+		}
+		delay = 0
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyProtoListener) readHeader(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	br := bufio.NewReader(conn)
+	remote, err := readProxyHeader(br)
+	if err != nil {
+		verboseLogger.Printf("Dropping connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	pc := &proxyProtoConn{Conn: conn, r: br, remote: remote}
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, l.err
+	}
+	return conn, nil
+}
+
+func (l *proxyProtoListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// proxyProtoConn is an accepted connection whose header has been read.
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader // holds any bytes read past the header
+	remote net.Addr      // the client named by the header, or nil for LOCAL
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// SyscallConn exposes the socket, for -max-buffer-bytes.
+func (c *proxyProtoConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("not a socket")
+	}
+	return sc.SyscallConn()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from r and returns
+// the source address it names. Headers that carry no address, v1 UNKNOWN
+// and v2 LOCAL such as load balancer health checks, return nil.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Even the shortest v1 header is longer than the v2 signature
+	start, err := r.Peek(len(proxyProtoSig))
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	switch {
+	case bytes.Equal(start, proxyProtoSig):
+		return readProxyHeaderV2(r)
+	case string(start[:6]) == "PROXY ":
+		return readProxyHeaderV1(r)
+	}
+	return nil, errors.New("no PROXY protocol header")
+}
+
+// proxyHeaderV1Max is the longest v1 header the specification allows,
+// CRLF included.
+const proxyHeaderV1Max = 107
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyHeaderV1Max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("PROXY protocol v1 header too long or not CRLF-terminated")
+	}
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", text)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", text)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", hdr[12]&0xf)
+	}
+	// Only TCP over IPv4 and IPv6 is used; for other families the
+	// connection keeps its own address. TLVs after the addresses are
+	// ignored.
+	switch hdr[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY protocol v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY protocol v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
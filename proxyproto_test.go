@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyListener fails its first accepts with EMFILE, then hands out conns.
+type flakyListener struct {
+	net.Listener
+	failures int
+	conns    chan net.Conn
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l *flakyListener) Close() error {
+	close(l.conns)
+	return nil
+}
+
+// TestProxyProtoListenerRecovers checks that the accept loop survives a
+// transient error such as running out of file descriptors, and stops once
+// the listener is closed.
+func TestProxyProtoListenerRecovers(t *testing.T) {
+	setupTest(t)
+	inner := &flakyListener{failures: 3, conns: make(chan net.Conn)}
+	ln := newProxyProtoListener(inner)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		inner.conns <- server
+		client.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 6080\r\n"))
+	}()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		if got := c.RemoteAddr().String(); got != "203.0.113.7:51234" {
+			t.Errorf("RemoteAddr = %s, want 203.0.113.7:51234", got)
+		}
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection accepted after transient accept errors")
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// rampLimiter limits how fast new sessions start for -ramp-up, so clients
+// reconnecting all at once after a restart reach the backends gradually.
+// The rate rises linearly from one session per second at startup to
+// -ramp-up-rate at the end of the period, after which there is no limit.
+type rampLimiter struct {
+	bucket  *tokenBucket
+	start   time.Time
+	period  time.Duration
+	maxRate float64
+}
+
+// rampUp is set by -ramp-up.
+var rampUp *rampLimiter
+
+func newRampLimiter(period time.Duration, maxRate float64) *rampLimiter {
+	return &rampLimiter{bucket: newTokenBucket(1, 1), start: time.Now(), period: period, maxRate: maxRate}
+}
+
+// rate returns the sessions per second allowed elapsed into the period.
+func (l *rampLimiter) rate(elapsed time.Duration) float64 {
+	return 1 + (l.maxRate-1)*elapsed.Seconds()/l.period.Seconds()
+}
+
+// admit reports whether a new session may start now. If not, it also
+// returns a whole number of seconds after which a retry may succeed.
+func (l *rampLimiter) admit() (bool, int) {
+	elapsed := time.Since(l.start)
+	if elapsed >= l.period {
+		return true, 0
+	}
+	rate := l.rate(elapsed)
+	// A second's worth of sessions may start together
+	l.bucket.setRate(rate, max(rate, 1))
+	if l.bucket.allow() {
+		return true, 0
+	}
+	return false, int(math.Ceil(1 / rate))
+}
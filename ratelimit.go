@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket refilled at rate tokens per second and
+// holding at most burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// setRate changes the refill rate and the burst from now on.
+func (b *tokenBucket) setRate(rate, burst float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate, b.burst = rate, burst
+	b.tokens = min(b.tokens, burst)
+}
+
+// allow takes one token if available and reports whether it did.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long
+// the caller has to wait before the tokens are actually available.
+// Callers are served in the order they reserve.
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// totalLimiter caps the bytes per second of all sessions together for
+// -total-rate, or is nil.
+var totalLimiter *tokenBucket
+
+// totalRateChunk is the most bytes a session reserves from totalLimiter at
+// once. A large message is paid for a chunk at a time, so other sessions'
+// reservations interleave with it instead of queueing behind all of it.
+const totalRateChunk = 16 * 1024
+
+// throttleTotal waits until n more bytes fit under -total-rate.
+func throttleTotal(n int) {
+	if totalLimiter == nil {
+		return
+	}
+	for n > 0 {
+		chunk := min(n, totalRateChunk)
+		time.Sleep(totalLimiter.reserve(float64(chunk)))
+		n -= chunk
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+// reaperIntervalDefault is the default for -reaper-interval.
+const reaperIntervalDefault = time.Minute
+
+// startReaper runs every sweep each interval from a single goroutine. Each
+// sweep drops the stale entries of one per-client map under that map's own
+// lock. The returned function stops the reaper and waits for a sweep in
+// progress to finish.
+func startReaper(interval time.Duration, sweeps []func()) (stop func()) {
+	if len(sweeps) == 0 {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				for _, sweep := range sweeps {
+					sweep()
+				}
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
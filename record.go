@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// recorder captures the bytes a session proxies in each direction to files
+// under -record. In the raw format <id>-client.bin holds what the client
+// sent and <id>-target.bin what the target sent; in the pcap format
+// <id>.pcap holds both, timestamped, for Wireshark. A nil recorder records
+// nothing.
+type recorder struct {
+	mu        sync.Mutex
+	sessionID string
+	files     map[string]*recordFile
+	pcap      *pcapWriter
+	written   int64
+	// stopped is set once -record-max-bytes have been recorded, failed
+	// after a write error and closed by close; each ends the recording.
+	stopped bool
+	failed  bool
+	closed  bool
+}
+
+type recordFile struct {
+	f  *os.File
+	gz *gzip.Writer
+	w  io.Writer
+}
+
+// newRecorder opens the capture files for a session, or returns nil when
+// -record is not set.
+func newRecorder(sessionID string) (*recorder, error) {
+	if config.recordDir == "" {
+		return nil, nil
+	}
+	rec := &recorder{sessionID: sessionID, files: make(map[string]*recordFile)}
+	if config.recordFormat == "pcap" {
+		rf, err := createRecordFile(sessionID + ".pcap")
+		if err != nil {
+			return nil, err
+		}
+		rec.files[""] = rf
+		if rec.pcap, err = newPcapWriter(rf.w); err != nil {
+			rec.close()
+			return nil, err
+		}
+		return rec, nil
+	}
+	for direction, name := range map[string]string{toTarget: "client", toClient: "target"} {
+		rf, err := createRecordFile(sessionID + "-" + name + ".bin")
+		if err != nil {
+			rec.close()
+			return nil, err
+		}
+		rec.files[direction] = rf
+	}
+	return rec, nil
+}
+
+// createRecordFile creates the capture file name under -record, gzipped
+// with -record-compress.
+func createRecordFile(name string) (*recordFile, error) {
+	path := filepath.Join(config.recordDir, name)
+	if config.recordCompress {
+		path += ".gz"
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	rf := &recordFile{f: f, w: f}
+	if config.recordCompress {
+		rf.gz = gzip.NewWriter(f)
+		rf.w = rf.gz
+	}
+	return rf, nil
+}
+
+// setTarget tells the recorder the address the session connected to.
+func (rec *recorder) setTarget(target string) {
+	if rec == nil || rec.pcap == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.pcap.setTarget(target)
+}
+
+// write records p as sent in direction. Once -record-max-bytes have been
+// recorded for the session, recording stops but the session goes on.
+func (rec *recorder) write(direction string, p []byte) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.stopped || rec.failed || rec.closed {
+		return
+	}
+	if config.recordMaxBytes > 0 && rec.written+int64(len(p)) > config.recordMaxBytes {
+		p = p[:config.recordMaxBytes-rec.written]
+		rec.stopped = true
+		logger.Printf("Session %s: recording stopped after %d bytes", rec.sessionID, config.recordMaxBytes)
+	}
+	var err error
+	if rec.pcap != nil {
+		err = rec.pcap.write(direction, p)
+	} else {
+		_, err = rec.files[direction].w.Write(p)
+	}
+	if err != nil {
+		logger.Printf("Session %s: recording error: %v", rec.sessionID, err)
+		rec.failed = true
+	}
+	rec.written += int64(len(p))
+}
+
+// close flushes and closes the capture files. A pcap capture cut short by
+// -record-max-bytes still gets its closing packets; one that failed to
+// write doesn't.
+func (rec *recorder) close() {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.closed {
+		return
+	}
+	rec.closed = true
+	if rec.pcap != nil && !rec.failed {
+		if err := rec.pcap.close(); err != nil {
+			logger.Printf("Session %s: recording error: %v", rec.sessionID, err)
+		}
+	}
+	for _, rf := range rec.files {
+		if rf.gz != nil {
+			if err := rf.gz.Close(); err != nil {
+				logger.Printf("Session %s: recording error: %v", rec.sessionID, err)
+			}
+		}
+		rf.f.Close()
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPcapRecordMaxBytesEndsWithFIN checks that a pcap capture cut short
+// by -record-max-bytes still records the connection closing.
+func TestPcapRecordMaxBytesEndsWithFIN(t *testing.T) {
+	setupTest(t)
+	config.recordDir = t.TempDir()
+	config.recordFormat = "pcap"
+	config.recordMaxBytes = 10
+	rec, err := newRecorder("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.setTarget("127.0.0.1:5900")
+	rec.write(toTarget, []byte("12345678"))
+	rec.write(toClient, []byte("abcdefgh"))
+	rec.write(toTarget, []byte("ignored"))
+	rec.close()
+
+	b, err := os.ReadFile(filepath.Join(config.recordDir, "s1.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags []byte
+	payload := 0
+	for b = b[24:]; len(b) >= 16; {
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		pkt := b[16 : 16+n]
+		flags = append(flags, pkt[20+13])
+		payload += n - 40
+		b = b[16+n:]
+	}
+	if payload != 10 {
+		t.Errorf("capture holds %d payload bytes, want 10", payload)
+	}
+	want := []byte{tcpFIN | tcpACK, tcpFIN | tcpACK, tcpACK}
+	if !bytes.HasSuffix(flags, want) {
+		t.Errorf("capture ends with TCP flags %x, want %x", flags, want)
+	}
+}
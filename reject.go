@@ -0,0 +1,29 @@
+package main
+
+import "net/http"
+
+// Reasons a request is refused by policy before the upgrade, as reported
+// in the rejections metric. Backend trouble is never a rejection; it is
+// answered with 503 (502 for an -eager-dial failure) or, after the upgrade,
+// close code 1013 and counted in dial_failures.
+const (
+	rejectBody        = "body"        // the handshake request has a body
+	rejectBadTarget   = "bad_target"  // the request names no valid target
+	rejectTargetPort  = "target_port" // the target port is outside -allowed-ports
+	rejectConnLimit   = "conn_limit"  // -max-connections-per-ip reached
+	rejectSubprotocol = "subprotocol" // -require-subprotocol and none shared
+	rejectOrigin      = "origin"      // -require-origin and no Origin header
+)
+
+// hasBody reports whether r announces a body, which a WebSocket handshake
+// never has.
+func hasBody(r *http.Request) bool {
+	return r.ContentLength != 0 || len(r.TransferEncoding) > 0
+}
+
+// reject refuses r by policy with status and a body saying why, and counts
+// it under reason.
+func reject(w http.ResponseWriter, route string, status int, reason, body string) {
+	metrics.rejected(route, reason)
+	http.Error(w, body, status)
+}
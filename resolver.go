@@ -0,0 +1,45 @@
+package main
+
+import "net/http"
+
+// targetResolver picks the backend address for a WebSocket request. Every
+// routing mode is a targetResolver, so the proxy itself only ever asks for
+// an address.
+type targetResolver interface {
+	Resolve(r *http.Request) (string, error)
+}
+
+// requestError is returned by resolvers when the request itself can't be
+// routed, such as a -target-template value missing from it, as opposed to
+// no backend being available.
+type requestError struct {
+	err error
+}
+
+func (e requestError) Error() string { return e.err.Error() }
+func (e requestError) Unwrap() error { return e.err }
+
+// staticResolver resolves every request to the same target.
+type staticResolver string
+
+func (s staticResolver) Resolve(*http.Request) (string, error) {
+	return string(s), nil
+}
+
+// candidateResolver is implemented by resolvers that can offer several
+// backends for a request, in the order they should be tried.
+type candidateResolver interface {
+	Candidates(r *http.Request) ([]string, error)
+}
+
+// resolveTargets returns the backends to try for r.
+func resolveTargets(resolver targetResolver, r *http.Request) ([]string, error) {
+	if cr, ok := resolver.(candidateResolver); ok {
+		return cr.Candidates(r)
+	}
+	target, err := resolver.Resolve(r)
+	if err != nil {
+		return nil, err
+	}
+	return []string{target}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// route maps a WebSocket path to the backend it proxies to.
+type route struct {
+	path         string
+	target       string
+	subprotocols []string
+}
+
+// parseRoutes parses -route values of the form /path=host:port, optionally
+// followed by ;proto1,proto2 naming the subprotocols the route negotiates
+// instead of defaultSubprotocols.
+func parseRoutes(values []string) ([]route, error) {
+	var routes []route
+	seen := make(map[string]bool)
+	for _, v := range values {
+		routePath, target, ok := strings.Cut(v, "=")
+		if !ok || target == "" {
+			return nil, fmt.Errorf("invalid route %q: expected /path=host:port", v)
+		}
+		subprotocols := defaultSubprotocols
+		if t, protos, ok := strings.Cut(target, ";"); ok {
+			target, subprotocols = t, nil
+			for _, p := range strings.Split(protos, ",") {
+				p = strings.TrimSpace(p)
+				if !validHeaderName(p) {
+					return nil, fmt.Errorf("invalid route %q: bad subprotocol %q", v, p)
+				}
+				subprotocols = append(subprotocols, p)
+			}
+		}
+		if err := checkRoutePath(routePath); err != nil {
+			return nil, fmt.Errorf("invalid route %q: %v", v, err)
+		}
+		if seen[routePath] {
+			return nil, fmt.Errorf("duplicate route for path %s", routePath)
+		}
+		seen[routePath] = true
+		routes = append(routes, route{path: routePath, target: target, subprotocols: subprotocols})
+	}
+	return routes, nil
+}
+
+// reservedPaths are served by websockify itself, so no -route may take
+// them; everything under /admin/ is reserved too.
+var reservedPaths = []string{"/healthz", "/livez", "/readyz", testPagePath}
+
+// checkRoutePath reports why p can't be a -route path: http.ServeMux would
+// panic on registering it, or it would shadow one of websockify's own
+// handlers.
+func checkRoutePath(p string) error {
+	if !strings.HasPrefix(p, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if i := strings.IndexFunc(p, func(r rune) bool {
+		return r <= ' ' || r == 0x7f || strings.ContainsRune("{}%", r)
+	}); i >= 0 {
+		return fmt.Errorf("path may not contain %q", p[i])
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	if clean != p {
+		return fmt.Errorf("path is not clean, use %s", clean)
+	}
+	if p == "/" {
+		return fmt.Errorf("/ is the default target's path")
+	}
+	trimmed := strings.TrimSuffix(p, "/")
+	if trimmed == "/admin" || strings.HasPrefix(p, "/admin/") || slices.Contains(reservedPaths, trimmed) {
+		return fmt.Errorf("%s is reserved for websockify's own handlers", p)
+	}
+	return nil
+}
+
+// newProxyHandler returns a handler that proxies WebSocket connections on
+// rt.
+func newProxyHandler(rt proxyRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		proxy(w, r, rt)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseRoutesRejectsBadPaths(t *testing.T) {
+	tests := [][]string{
+		{"vnc=127.0.0.1:5900"},
+		{"/=127.0.0.1:5900"},
+		{"/healthz=127.0.0.1:5900"},
+		{"/livez/=127.0.0.1:5900"},
+		{"/readyz=127.0.0.1:5900"},
+		{"/admin=127.0.0.1:5900"},
+		{"/admin/sessions=127.0.0.1:5900"},
+		{testPagePath + "=127.0.0.1:5900"},
+		{"/vnc/{id}=127.0.0.1:5900"},
+		{"/vnc/{$}=127.0.0.1:5900"},
+		{"/a%zz=127.0.0.1:5900"},
+		{"/vnc /x=127.0.0.1:5900"},
+		{"/a/../b=127.0.0.1:5900"},
+		{"/a//b=127.0.0.1:5900"},
+		{"/vnc=127.0.0.1:5900", "/vnc=127.0.0.1:5901"},
+	}
+	for _, values := range tests {
+		if _, err := parseRoutes(values); err == nil {
+			t.Errorf("parseRoutes(%q) succeeded, want an error", values)
+		}
+	}
+}
+
+// TestParseRoutesRegisters checks that accepted routes register next to
+// websockify's own handlers without http.ServeMux panicking.
+func TestParseRoutesRegisters(t *testing.T) {
+	routes, err := parseRoutes([]string{"/vnc=127.0.0.1:5900", "/ssh/=127.0.0.1:22;ssh", "/healthz-backend=127.0.0.1:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	for _, p := range append([]string{"/", "/admin/logs", "GET /admin/sessions", "DELETE /admin/sessions/{id}"}, reservedPaths...) {
+		mux.HandleFunc(p, func(http.ResponseWriter, *http.Request) {})
+	}
+	for _, rt := range routes {
+		mux.HandleFunc(rt.path, func(http.ResponseWriter, *http.Request) {})
+	}
+}
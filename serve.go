@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// listenerResult is what a listener's serve loop returned.
+type listenerResult struct {
+	name     string
+	critical bool
+	err      error
+}
+
+// listenerGroup runs the server's listeners and collects their errors, so
+// one failing listener doesn't have to take the others down with it.
+type listenerGroup struct {
+	results chan listenerResult
+	running int
+	servers []*http.Server
+}
+
+func newListenerGroup() *listenerGroup {
+	return &listenerGroup{results: make(chan listenerResult)}
+}
+
+// serve runs srv on ln in its own goroutine. A critical listener failing
+// makes wait return; others are only logged. Binding must already have
+// happened so bind errors are reported before anything starts serving.
+func (g *listenerGroup) serve(name string, critical bool, srv *http.Server, ln net.Listener) {
+	g.running++
+	g.servers = append(g.servers, srv)
+	go func() {
+		g.results <- listenerResult{name: name, critical: critical, err: srv.Serve(ln)}
+	}()
+}
+
+// wait blocks until a critical listener fails or every listener has
+// stopped. It returns nil only if all of them were shut down cleanly.
+func (g *listenerGroup) wait() error {
+	var failed error
+	for ; g.running > 0; g.running-- {
+		res := <-g.results
+		if errors.Is(res.err, http.ErrServerClosed) {
+			continue
+		}
+		logger.Printf("%s listener stopped: %v", res.name, res.err)
+		failed = fmt.Errorf("%s listener: %w", res.name, res.err)
+		if res.critical {
+			return failed
+		}
+	}
+	return failed
+}
+
+// shutdown stops every listener from accepting new connections. Hijacked
+// WebSocket connections are not affected; see sessionRegistry.
+func (g *listenerGroup) shutdown(ctx context.Context) {
+	for _, srv := range g.servers {
+		srv.Shutdown(ctx)
+	}
+}
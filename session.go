@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newSessionID returns a random identifier used to correlate the log lines
+// of a single proxied connection.
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Directions of proxied data, used in trace output and recordings.
+const (
+	toTarget = "client->target"
+	toClient = "target->client"
+)
+
+// session is a proxied WebSocket connection tracked while it runs.
+type session struct {
+	id       string
+	route    string
+	clientIP string
+	started  time.Time
+	conn     *wsConn
+
+	// serverName is the TLS SNI name the client asked for, or "".
+	serverName string
+
+	// traceParent is the handshake's W3C traceparent header, for -otlp-endpoint.
+	traceParent string
+
+	// target is set once the backend is connected.
+	target atomic.Pointer[string]
+
+	toClientBytes atomic.Int64
+	toTargetBytes atomic.Int64
+
+	// firstToClient and firstToTarget are how long after the upgrade the
+	// first bytes from the target and from the client were proxied, or 0
+	// before they were.
+	firstToClient atomic.Int64
+	firstToTarget atomic.Int64
+
+	cause atomic.Pointer[string]
+}
+
+// Why a session ended, as recorded by setCloseCause.
+const (
+	causeClient  = "client"  // the client closed or went away
+	causeBackend = "backend" // the target closed the connection
+	causeProxy   = "proxy"   // a limit or timeout of ours ended it
+	causeError   = "error"   // a read or write failed
+)
+
+// setCloseCause records why the session is ending. Only the first cause
+// sticks: once one side has ended the session, the errors the teardown
+// causes on the other side say nothing about why.
+func (s *session) setCloseCause(cause string) {
+	s.cause.CompareAndSwap(nil, &cause)
+}
+
+// closeCause returns the recorded close cause, or causeError if none was.
+func (s *session) closeCause() string {
+	if c := s.cause.Load(); c != nil {
+		return *c
+	}
+	return causeError
+}
+
+// readCause classifies an error reading from the client.
+func readCause(err error) string {
+	var ce *websocket.CloseError
+	var ne net.Error
+	switch {
+	case errors.As(err, &ce):
+		return causeClient
+	case errors.As(err, &ne) && ne.Timeout():
+		return causeProxy // -pong-timeout or -ws-read-deadline
+	}
+	return causeError
+}
+
+// readFailed records why reading from the client failed with err and logs
+// it: a normal close from the client only verbosely, and a read deadline in
+// plain words, naming the flag that set it.
+func (s *session) readFailed(err error) {
+	s.setCloseCause(readCause(err))
+	var ne net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+		verboseLogger.Printf("Session %s: client closed (%v)", s.id, err)
+	case errors.As(err, &ne) && ne.Timeout():
+		if d := s.conn.readDeadline(); !d.IsZero() && !time.Now().Before(d) {
+			logger.Printf("Session %s: client idle past -ws-read-deadline (%v), closing", s.id, config.wsReadDeadline)
+		} else {
+			logger.Printf("Session %s: no pong within -pong-timeout (%v), closing", s.id, config.pongTimeout)
+		}
+	default:
+		logger.Printf("WebSocket read error: %v", err)
+	}
+}
+
+// setTarget records the backend the session is connected to.
+func (s *session) setTarget(target string) {
+	s.target.Store(&target)
+}
+
+// targetAddr returns the backend the session is connected to, or "" before
+// it is connected.
+func (s *session) targetAddr() string {
+	if t := s.target.Load(); t != nil {
+		return *t
+	}
+	return ""
+}
+
+// count adds n bytes proxied in direction to the session's totals and
+// notes when the first bytes went each way.
+func (s *session) count(direction string, n int) {
+	bytes, first := &s.toTargetBytes, &s.firstToTarget
+	if direction == toClient {
+		bytes, first = &s.toClientBytes, &s.firstToClient
+	}
+	bytes.Add(int64(n))
+	if n > 0 && first.Load() == 0 {
+		first.CompareAndSwap(0, int64(max(time.Since(s.started), 1)))
+	}
+}
+
+// firstByteLatencies describes how long the session waited for the first
+// bytes from each side, for the session summary.
+func (s *session) firstByteLatencies() string {
+	describe := func(first *atomic.Int64) string {
+		if d := first.Load(); d != 0 {
+			return "after " + time.Duration(d).Round(100*time.Microsecond).String()
+		}
+		return "never"
+	}
+	return "first byte from target " + describe(&s.firstToClient) + ", from client " + describe(&s.firstToTarget)
+}
+
+// terminate sends the client a close frame with code and reason and closes
+// the connection. That ends the session's proxy loops, whose teardown
+// closes the target connection too.
+func (s *session) terminate(code int, reason string) {
+	s.setCloseCause(causeProxy)
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	s.conn.Close()
+}
+
+// onceCloser returns a function that closes c the first time it is called,
+// so the teardown of both proxy directions and the control channel can all
+// close the target without racing each other.
+func onceCloser(c io.Closer) func() {
+	var once sync.Once
+	return func() { once.Do(func() { c.Close() }) }
+}
+
+// sessionRegistry tracks the running sessions so shutdown can wait for
+// them to finish and /admin/sessions can list them.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	done     sync.WaitGroup
+}
+
+var sessions = sessionRegistry{sessions: make(map[string]*session)}
+
+func (reg *sessionRegistry) add(s *session) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.sessions[s.id] = s
+	reg.done.Add(1)
+}
+
+func (reg *sessionRegistry) remove(s *session) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.sessions[s.id]; ok {
+		delete(reg.sessions, s.id)
+		reg.done.Done()
+	}
+}
+
+// count returns the number of running sessions.
+func (reg *sessionRegistry) count() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return len(reg.sessions)
+}
+
+// get returns the running session with the given id, or nil.
+func (reg *sessionRegistry) get(id string) *session {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.sessions[id]
+}
+
+// list returns the running sessions, oldest first.
+func (reg *sessionRegistry) list() []*session {
+	reg.mu.Lock()
+	running := make([]*session, 0, len(reg.sessions))
+	for _, s := range reg.sessions {
+		running = append(running, s)
+	}
+	reg.mu.Unlock()
+	slices.SortFunc(running, func(a, b *session) int { return a.started.Compare(b.started) })
+	return running
+}
+
+// closeAll terminates every running session with code and reason, each in
+// its own goroutine so a close stuck on one client doesn't hold up the rest.
+// It waits for all of them; callers that must not block run it in a
+// goroutine.
+func (reg *sessionRegistry) closeAll(code int, reason string) {
+	var wg sync.WaitGroup
+	for _, s := range reg.list() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.terminate(code, reason)
+		}()
+	}
+	wg.Wait()
+}
+
+// ended returns a channel closed once every session has ended.
+func (reg *sessionRegistry) ended() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		reg.done.Wait()
+		close(done)
+	}()
+	return done
+}
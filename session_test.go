@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// countingConn counts the calls to Close that reach the connection.
+type countingConn struct {
+	net.Conn
+	closes atomic.Int32
+}
+
+func (c *countingConn) Close() error {
+	c.closes.Add(1)
+	return c.Conn.Close()
+}
+
+// race runs f from n goroutines released at the same time.
+func race(n int, f func(i int)) {
+	var start, done sync.WaitGroup
+	start.Add(1)
+	for i := range n {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			f(i)
+		}()
+	}
+	start.Done()
+	done.Wait()
+}
+
+func TestOnceCloserConcurrent(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := &countingConn{Conn: a}
+	closeTarget := onceCloser(c)
+	race(8, func(int) { closeTarget() })
+	if n := c.closes.Load(); n != 1 {
+		t.Errorf("target closed %d times, want 1", n)
+	}
+}
+
+func TestWSConnCloseConcurrent(t *testing.T) {
+	conn, _ := wsPair(t)
+	errs := make([]error, 8)
+	race(len(errs), func(i int) { errs[i] = conn.Close() })
+	for i, err := range errs {
+		if err != errs[0] {
+			t.Errorf("Close call %d returned %v, call 0 returned %v", i, err, errs[0])
+		}
+	}
+}
+
+func TestCloseCauseFirstWins(t *testing.T) {
+	causes := []string{causeClient, causeBackend, causeProxy, causeError}
+	for range 100 {
+		sess := &session{}
+		seen := make([]string, len(causes))
+		race(len(causes), func(i int) {
+			sess.setCloseCause(causes[i])
+			seen[i] = sess.closeCause()
+		})
+		// Every goroutine saw the cause that won, and it stays
+		for i, c := range seen {
+			if c != seen[0] {
+				t.Fatalf("goroutine %d saw cause %q, goroutine 0 saw %q", i, c, seen[0])
+			}
+		}
+		sess.setCloseCause(causeError)
+		if got := sess.closeCause(); got != seen[0] {
+			t.Fatalf("closeCause changed from %q to %q", seen[0], got)
+		}
+	}
+}
+
+// TestSimultaneousClose closes the client and the target of a session at
+// the same moment. The target must be closed exactly once, and the session
+// must be put down to whichever side closed, never to the teardown errors
+// the other side then sees.
+func TestSimultaneousClose(t *testing.T) {
+	out := setupTest(t)
+	config.resolver = staticResolver("target.test:5900")
+	targets := make(chan net.Conn, 1)
+	var proxySides []*countingConn
+	config.dialContext = func(ctx context.Context, target string) (net.Conn, error) {
+		a, b := net.Pipe()
+		c := &countingConn{Conn: a}
+		proxySides = append(proxySides, c)
+		targets <- b
+		return c, nil
+	}
+	srv := startProxy(t)
+
+	const sessionsRun = 20
+	for range sessionsRun {
+		client, _, err := dialProxy(t, srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := <-targets
+		race(2, func(i int) {
+			if i == 0 {
+				client.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				client.Close()
+			} else {
+				target.Close()
+			}
+		})
+	}
+	waitFor(t, "sessions to end", func() bool {
+		return strings.Count(out.String(), " ended by ") == sessionsRun && sessions.count() == 0
+	})
+	for i, c := range proxySides {
+		if n := c.closes.Load(); n != 1 {
+			t.Errorf("session %d closed its target %d times, want 1", i, n)
+		}
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, " ended by ") && !strings.Contains(line, "ended by client") && !strings.Contains(line, "ended by backend") {
+			t.Errorf("session put down to the teardown: %s", line)
+		}
+		if strings.Contains(line, "error:") {
+			t.Errorf("teardown logged an error: %s", line)
+		}
+	}
+}
+
+// TestNormalCloseLogsNoError ends sessions the normal ways, the target
+// hanging up and the client closing, and checks that the teardown that
+// follows, which closes the other side under its reading loop, logs no
+// error.
+func TestNormalCloseLogsNoError(t *testing.T) {
+	out := setupTest(t)
+	targets := pipeTarget(t, nil)
+	srv := startProxy(t)
+
+	for _, byTarget := range []bool{true, false} {
+		client, _, err := dialProxy(t, srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := <-targets
+		if byTarget {
+			target.Close()
+		} else {
+			client.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			client.Close()
+		}
+	}
+	waitFor(t, "sessions to end", func() bool {
+		return strings.Count(out.String(), "Closed TCP to WS") == 2 && sessions.count() == 0
+	})
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(strings.ToLower(line), "error") {
+			t.Errorf("normal close logged an error: %s", line)
+		}
+	}
+}
+
+// TestWSReadDeadlineLogged checks that a client idle past -ws-read-deadline
+// is closed by the proxy with a plain message, not as a read error.
+func TestWSReadDeadlineLogged(t *testing.T) {
+	out := setupTest(t)
+	config.wsReadDeadline = 50 * time.Millisecond
+	pipeTarget(t, nil)
+	if _, _, err := dialProxy(t, startProxy(t)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the session to end", func() bool {
+		return strings.Contains(out.String(), " ended by ") && sessions.count() == 0
+	})
+	log := out.String()
+	if !strings.Contains(log, "client idle past -ws-read-deadline") {
+		t.Errorf("no -ws-read-deadline message logged:\n%s", log)
+	}
+	if !strings.Contains(log, "ended by proxy") || strings.Contains(log, "read error") {
+		t.Errorf("deadline logged as an error:\n%s", log)
+	}
+}
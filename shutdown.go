@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once shutdown has begun; /livez and /readyz report it.
+var draining atomic.Bool
+
+// runOnceDone is closed when the single -run-once session has ended, which
+// makes main shut down.
+var runOnceDone = make(chan struct{})
+
+// drain refuses new sessions and waits up to -drain-timeout for the
+// running ones to end, then closes those left with -shutdown-close-code and
+// waits for them until -drain-deadline before stopping the listeners. The
+// listeners stay up meanwhile so /livez and /readyz can report the drain to
+// load balancers. It reports whether sessions were still open at the
+// deadline, in which case main exits with exitForcedShutdown.
+func drain(sig os.Signal, listeners *listenerGroup) (forced bool) {
+	logger.Printf("Received %v, draining %d sessions", sig, sessions.count())
+	draining.Store(true)
+	start := time.Now()
+
+	ended := sessions.ended()
+	if waitSessions(ended, start.Add(config.drainTimeout), "the drain timeout") {
+		logger.Println("All sessions closed, exiting")
+	} else {
+		logger.Printf("Drain timeout after %v, closing %d sessions", config.drainTimeout, sessions.count())
+		// Close them in the background: a close stuck on an unresponsive
+		// client must not keep the deadline below from forcing the exit
+		go sessions.closeAll(config.shutdownCloseCode, "server shutting down")
+		// Give the sessions until the deadline to log and report how
+		// they ended
+		if !waitSessions(ended, start.Add(config.drainDeadline), "the drain deadline") {
+			logger.Printf("Drain deadline after %v, exiting with %d sessions still open", config.drainDeadline, sessions.count())
+			forced = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	listeners.shutdown(ctx)
+	return forced
+}
+
+// drainProgressInterval is how often drain logs the sessions still open.
+const drainProgressInterval = 5 * time.Second
+
+// waitSessions waits until ended is closed or deadline passes, logging the
+// open sessions and the time left until what every drainProgressInterval.
+// It reports whether all sessions ended.
+func waitSessions(ended <-chan struct{}, deadline time.Time, what string) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	ticker := time.NewTicker(drainProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ended:
+			return true
+		case <-timer.C:
+			return false
+		case <-ticker.C:
+			logger.Printf("Draining: %d sessions open, %v until %s",
+				sessions.count(), time.Until(deadline).Round(time.Second), what)
+		}
+	}
+}
+
+// exitForcedShutdown is the exit status when -drain-deadline passed with
+// sessions still open, so restart scripts can tell a forced shutdown from
+// a clean one.
+const exitForcedShutdown = 4
+
+// validCloseCode reports whether code may be sent in a close frame: a
+// defined code from RFC 6455 and its registry, or one in the ranges for
+// libraries (3000-3999) and applications (4000-4999). 1005, 1006 and 1015
+// are reserved for reporting and never sent.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// drainTimeoutDefault is the default for -drain-timeout.
+const drainTimeoutDefault = 30 * time.Second
+
+// drainDeadlineAfterTimeout is how long after -drain-timeout the default
+// -drain-deadline falls: enough for closed sessions to log how they ended.
+const drainDeadlineAfterTimeout = time.Second
+
+// shutdownCloseCodeDefault is the default for -shutdown-close-code: 1001
+// "going away", which tells clients the server is restarting and a
+// reconnect may succeed.
+const shutdownCloseCodeDefault = 1001
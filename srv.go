@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvCacheTTL is how long resolved SRV records are reused.
+const srvCacheTTL = 30 * time.Second
+
+// srvLookupTimeout bounds each SRV lookup, so a stuck DNS server fails the
+// handshake instead of holding it.
+const srvLookupTimeout = 5 * time.Second
+
+// srvResolver discovers backends from the DNS SRV records of name, such as
+// Consul's DNS interface.
+type srvResolver struct {
+	name string
+
+	mu       sync.Mutex
+	records  []*net.SRV
+	resolved time.Time
+}
+
+func newSRVResolver(name string) *srvResolver {
+	return &srvResolver{name: name}
+}
+
+func (s *srvResolver) Resolve(r *http.Request) (string, error) {
+	targets, err := s.Candidates(r)
+	if err != nil {
+		return "", err
+	}
+	return targets[0], nil
+}
+
+// Candidates returns every backend in the order they should be tried:
+// by priority, and within a priority weighted at random as in RFC 2782.
+func (s *srvResolver) Candidates(r *http.Request) ([]string, error) {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	records, err := s.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for i := 0; i < len(records); {
+		j := i
+		for j < len(records) && records[j].Priority == records[i].Priority {
+			j++
+		}
+		for _, rec := range shuffleByWeight(records[i:j]) {
+			host := strings.TrimSuffix(rec.Target, ".")
+			targets = append(targets, net.JoinHostPort(host, strconv.Itoa(int(rec.Port))))
+		}
+		i = j
+	}
+	return targets, nil
+}
+
+// lookup returns the SRV records sorted by priority, from cache while it is
+// fresh unless -target-resolve-each-connection is set. The lookup itself
+// runs without the lock, so a slow one holds up only the requests that
+// need it.
+func (s *srvResolver) lookup(ctx context.Context) ([]*net.SRV, error) {
+	s.mu.Lock()
+	if !config.resolveEach && s.records != nil && time.Since(s.resolved) < srvCacheTTL {
+		records := s.records
+		s.mu.Unlock()
+		return records, nil
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, srvLookupTimeout)
+	defer cancel()
+	_, records, err := targetResolverDNS().LookupSRV(ctx, "", "", s.name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.records, s.resolved = records, time.Now()
+	s.mu.Unlock()
+	return records, nil
+}
+
+// shuffleByWeight orders records of equal priority by repeated weighted
+// random selection.
+func shuffleByWeight(records []*net.SRV) []*net.SRV {
+	left := append([]*net.SRV(nil), records...)
+	out := make([]*net.SRV, 0, len(left))
+	for len(left) > 0 {
+		total := 0
+		for _, rec := range left {
+			total += int(rec.Weight) + 1
+		}
+		n := rand.Intn(total)
+		i := 0
+		for ; n >= int(left[i].Weight)+1; i++ {
+			n -= int(left[i].Weight) + 1
+		}
+		out = append(out, left[i])
+		left = append(left[:i], left[i+1:]...)
+	}
+	return out
+}
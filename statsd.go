@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdSink sends metrics to a StatsD server over UDP using the plain line
+// protocol, with DogStatsD "|#route:..." tags unless -statsd-tags=false.
+// Sends are fire and forget; a missing StatsD server never slows the proxy.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+}
+
+// newStatsdSink opens a UDP socket to addr.
+func newStatsdSink(addr, prefix string, tags bool) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &statsdSink{conn: conn, prefix: prefix, tags: tags}, nil
+}
+
+// send writes one metric line. value and kind are the "<value>|<type>"
+// parts of the protocol, and tags are DogStatsD "name:value" tags.
+func (s *statsdSink) send(name, value, kind string, tags ...string) {
+	line := s.prefix + name + ":" + value + "|" + kind
+	if s.tags && len(tags) > 0 {
+		for i, tag := range tags {
+			tags[i] = statsdTagValue(tag)
+		}
+		line += "|#" + strings.Join(tags, ",")
+	}
+	s.conn.Write([]byte(line))
+}
+
+func (s *statsdSink) sessionStarted(route string) {
+	s.send("connections", "1", "c", "route:"+route)
+}
+
+func (s *statsdSink) sessionEnded(route, cause string, d time.Duration, toClient, toTarget int64) {
+	s.send("session.duration", fmt.Sprint(d.Milliseconds()), "ms", "route:"+route, "cause:"+cause)
+	s.send("bytes.to_client", fmt.Sprint(toClient), "c", "route:"+route)
+	s.send("bytes.to_target", fmt.Sprint(toTarget), "c", "route:"+route)
+	s.send("sessions.closed", "1", "c", "route:"+route, "cause:"+cause)
+}
+
+func (s *statsdSink) dialFailed(route string) {
+	s.send("dial_failures", "1", "c", "route:"+route)
+}
+
+func (s *statsdSink) rejected(route, reason string) {
+	s.send("rejections", "1", "c", "route:"+route, "reason:"+reason)
+}
+
+// statsdTagValue replaces the characters that would break a DogStatsD tag
+// list.
+func statsdTagValue(v string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_").Replace(v)
+}
@@ -0,0 +1,22 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// newSyslogWriter connects to the local syslog daemon, or to a remote one
+// when addr is given as [udp://|tcp://]host:port.
+func newSyslogWriter(addr string) (io.Writer, error) {
+	network := ""
+	if addr != "" {
+		network = "udp"
+		if n, a, ok := strings.Cut(addr, "://"); ok {
+			network, addr = n, a
+		}
+	}
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "websockify")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// templateResolver fills -target-template placeholders from the request.
+// {name} takes the query parameter name and {N} the Nth path segment,
+// counting from 1. With -client-ca, {cert.cn} takes the common name of the
+// verified client certificate and {cert.dns} its first DNS name, so clients
+// can be routed by identity. Values may only hold letters, digits, '-', '_' and '.',
+// so a request can't smuggle in a port or a second address.
+type templateResolver string
+
+// parseTargetTemplate checks that every placeholder in tmpl is closed and
+// non-empty.
+func parseTargetTemplate(tmpl string) (templateResolver, error) {
+	rest := tmpl
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed placeholder in %q", tmpl)
+		}
+		if end == 1 {
+			return "", fmt.Errorf("empty placeholder in %q", tmpl)
+		}
+		rest = rest[open+end+1:]
+	}
+	if strings.IndexByte(rest, '}') >= 0 {
+		return "", fmt.Errorf("unmatched } in %q", tmpl)
+	}
+	return templateResolver(tmpl), nil
+}
+
+// Resolve fills in the template. Every failure is the request's fault, so
+// all are returned as requestError.
+func (t templateResolver) Resolve(r *http.Request) (string, error) {
+	target, err := t.fill(r)
+	if err != nil {
+		return "", requestError{err}
+	}
+	verboseLogger.Printf("Resolved %s to target %s", r.URL, target)
+	return target, nil
+}
+
+func (t templateResolver) fill(r *http.Request) (string, error) {
+	var b strings.Builder
+	rest := string(t)
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := open + strings.IndexByte(rest[open:], '}')
+		b.WriteString(rest[:open])
+		name := rest[open+1 : end]
+		value, err := templateValue(r, name)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		rest = rest[end+1:]
+	}
+
+	target := b.String()
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return "", fmt.Errorf("template produced invalid address %q", target)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("template produced invalid port in %q", target)
+	}
+	return target, nil
+}
+
+// templateValue returns the request value for placeholder name.
+func templateValue(r *http.Request, name string) (string, error) {
+	var value string
+	if n, err := strconv.Atoi(name); err == nil {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if n < 1 || n > len(segments) {
+			return "", fmt.Errorf("path has no segment %d", n)
+		}
+		value = segments[n-1]
+	} else if name == "cert.cn" || name == "cert.dns" {
+		cert := clientCertificate(r)
+		if cert == nil {
+			return "", fmt.Errorf("{%s} needs a verified client certificate", name)
+		}
+		if name == "cert.cn" {
+			value = cert.Subject.CommonName
+		} else if len(cert.DNSNames) > 0 {
+			value = cert.DNSNames[0]
+		}
+	} else {
+		value = r.URL.Query().Get(name)
+	}
+	if value == "" {
+		return "", fmt.Errorf("missing value for {%s}", name)
+	}
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", fmt.Errorf("invalid character in value for {%s}", name)
+		}
+	}
+	return value, nil
+}
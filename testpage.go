@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// testPagePath is where -test-page serves testPageHTML.
+const testPagePath = "/websockify-test"
+
+// testPageHTML is a self-contained client for checking a proxy end to end
+// from a browser: it connects to the path in the form, hexdumps every
+// message it receives and sends the input as a binary message.
+const testPageHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>websockify test client</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+#log { font-family: monospace; white-space: pre; border: 1px solid #ccc; padding: .5em; height: 60vh; overflow: auto; }
+.out { color: #06c; } .info { color: #888; }
+</style>
+</head>
+<body>
+<h1>websockify test client</h1>
+<form id="connect">
+Path <input id="path" value="/" size="30">
+<button id="toggle">Connect</button>
+<span id="state" class="info">disconnected</span>
+</form>
+<div id="log"></div>
+<form id="send">
+<input id="data" size="60" placeholder="text to send" disabled>
+<label><input type="checkbox" id="hex"> hex</label>
+<button id="sendbtn" disabled>Send</button>
+</form>
+<script>
+"use strict";
+const $ = id => document.getElementById(id);
+let ws = null;
+
+function log(text, cls) {
+  const line = document.createElement("div");
+  line.className = cls || "";
+  line.textContent = text;
+  $("log").appendChild(line);
+  $("log").scrollTop = $("log").scrollHeight;
+}
+
+function hexdump(bytes) {
+  const lines = [];
+  for (let off = 0; off < bytes.length; off += 16) {
+    const row = bytes.slice(off, off + 16);
+    const hex = Array.from(row, b => b.toString(16).padStart(2, "0")).join(" ");
+    const ascii = Array.from(row, b => b >= 32 && b < 127 ? String.fromCharCode(b) : ".").join("");
+    lines.push(off.toString(16).padStart(8, "0") + "  " + hex.padEnd(48) + "  " + ascii);
+  }
+  return lines.join("\n");
+}
+
+function setConnected(on) {
+  $("toggle").textContent = on ? "Disconnect" : "Connect";
+  $("data").disabled = $("sendbtn").disabled = !on;
+}
+
+$("connect").onsubmit = e => {
+  e.preventDefault();
+  if (ws) { ws.close(); return; }
+  const url = (location.protocol === "https:" ? "wss://" : "ws://") + location.host + $("path").value;
+  log("connecting to " + url, "info");
+  ws = new WebSocket(url, ["binary"]);
+  ws.binaryType = "arraybuffer";
+  ws.onopen = () => {
+    $("state").textContent = "connected" + (ws.protocol ? " (" + ws.protocol + ")" : "");
+    setConnected(true);
+  };
+  ws.onmessage = m => {
+    if (typeof m.data === "string") {
+      log("<- text: " + m.data);
+    } else {
+      const bytes = new Uint8Array(m.data);
+      log("<- " + bytes.length + " bytes\n" + hexdump(bytes));
+    }
+  };
+  ws.onclose = c => {
+    log("closed: code " + c.code + (c.reason ? ", " + c.reason : ""), "info");
+    $("state").textContent = "disconnected";
+    setConnected(false);
+    ws = null;
+  };
+};
+
+$("send").onsubmit = e => {
+  e.preventDefault();
+  let bytes;
+  if ($("hex").checked) {
+    const digits = $("data").value.replace(/\s+/g, "");
+    if (!/^([0-9a-fA-F]{2})*$/.test(digits)) { log("invalid hex", "info"); return; }
+    bytes = Uint8Array.from(digits.match(/../g) || [], h => parseInt(h, 16));
+  } else {
+    bytes = new TextEncoder().encode($("data").value);
+  }
+  ws.send(bytes);
+  log("-> " + bytes.length + " bytes\n" + hexdump(bytes), "out");
+  $("data").value = "";
+};
+</script>
+</body>
+</html>
+`
+
+// testPageHandler serves testPageHTML for -test-page.
+func testPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, testPageHTML)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Environment variables that may hold the PEM certificate and key instead
+// of -cert and -key, so secret managers don't have to write them to disk.
+const (
+	certPEMEnv = "WEBSOCKIFY_CERT_PEM"
+	keyPEMEnv  = "WEBSOCKIFY_KEY_PEM"
+)
+
+// tlsRequested reports whether a certificate or key was given in a flag or
+// in the environment.
+func tlsRequested(certFile, keyFile string) bool {
+	return certFile != "" || keyFile != "" || os.Getenv(certPEMEnv) != "" || os.Getenv(keyPEMEnv) != ""
+}
+
+// loadCertificate loads the certificate pair, each half from its file or
+// from its environment variable. Giving both sources for one half, or only
+// one half, is an error.
+func loadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := pemSource("-cert", certFile, certPEMEnv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := pemSource("-key", keyFile, keyPEMEnv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if (certPEM == nil) != (keyPEM == nil) {
+		return tls.Certificate{}, fmt.Errorf("a certificate and a key must be given together (-cert or $%s, -key or $%s)", certPEMEnv, keyPEMEnv)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// pemSource returns the PEM data from file or from the environment
+// variable env, or nil if neither is set.
+func pemSource(flagName, file, env string) ([]byte, error) {
+	inline := os.Getenv(env)
+	switch {
+	case file != "" && inline != "":
+		return nil, fmt.Errorf("give either %s or $%s, not both", flagName, env)
+	case file != "":
+		return os.ReadFile(file)
+	case inline != "":
+		return []byte(inline), nil
+	}
+	return nil, nil
+}
+
+// newTLSConfig loads the certificate pair and builds the server TLS
+// configuration.
+func newTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		SessionTicketsDisabled: !config.sessionTickets,
+		NextProtos:             config.alpn,
+	}
+	if config.ocspStaple != "" {
+		st, err := newStapler(config.ocspStaple, cert)
+		if err != nil {
+			return nil, fmt.Errorf("-ocsp-staple: %w", err)
+		}
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = st.getCertificate
+	}
+	if config.clientCAFile != "" {
+		cas, err := newClientCAWatcher(config.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = cas.pool.Load()
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if config.clientCRL != "" {
+			crl, err := newCRLChecker(config.clientCRL)
+			if err != nil {
+				return nil, fmt.Errorf("-client-crl: %w", err)
+			}
+			tlsConfig.VerifyConnection = crl.verifyConnection
+		}
+		// Session ticket keys set on tlsConfig later still apply, since
+		// the copies don't set their own
+		tlsConfig.GetConfigForClient = cas.configForClient(tlsConfig)
+	}
+	if config.sessionTickets && config.ticketRotate > 0 {
+		if err := rotateTicketKeys(tlsConfig, config.ticketRotate, config.sessionCacheSize); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// loadClientCAs reads the PEM bundle of CAs that -client-ca trusts to sign
+// client certificates.
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM certificates in " + file)
+	}
+	return pool, nil
+}
+
+// clientCertificate returns the client certificate verified against
+// -client-ca during the TLS handshake, or nil if there is none. Resolvers
+// use it to pick a backend by client identity.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// serverName returns the SNI server name the client sent in its TLS
+// handshake, or "" without TLS or SNI.
+func serverName(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return r.TLS.ServerName
+}
+
+// forServerName formats name for log lines as " for NAME", or "" if empty.
+func forServerName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return " for " + name
+}
+
+// knownALPN lists the ALPN protocol IDs -tls-alpn accepts, from the IANA
+// registry entries that make sense for an HTTP server.
+var knownALPN = []string{"http/1.0", "http/1.1", "h2"}
+
+// parseALPN parses the comma-separated -tls-alpn list.
+func parseALPN(v string) ([]string, error) {
+	var protos []string
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if !slices.Contains(knownALPN, p) {
+			return nil, fmt.Errorf("unknown ALPN protocol %q (known: %s)", p, strings.Join(knownALPN, ", "))
+		}
+		if !slices.Contains(protos, p) {
+			protos = append(protos, p)
+		}
+	}
+	if !slices.Contains(protos, "http/1.1") {
+		return nil, fmt.Errorf("ALPN list %q lacks http/1.1, which WebSocket upgrades require", v)
+	}
+	return protos, nil
+}
+
+// rotateTicketKeys installs a fresh session ticket key every interval. The
+// newest key encrypts new tickets; the previous keep-1 keys are still
+// accepted so recently issued tickets can resume.
+func rotateTicketKeys(tlsConfig *tls.Config, interval time.Duration, keep int) error {
+	if keep < 1 {
+		keep = 1
+	}
+	key, err := newTicketKey()
+	if err != nil {
+		return err
+	}
+	keys := [][32]byte{key}
+	tlsConfig.SetSessionTicketKeys(keys)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			key, err := newTicketKey()
+			if err != nil {
+				logger.Printf("Error rotating session ticket key: %v", err)
+				continue
+			}
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > keep {
+				keys = keys[:keep]
+			}
+			tlsConfig.SetSessionTicketKeys(keys)
+			verboseLogger.Printf("Rotated session ticket key, %d keys active", len(keys))
+		}
+	}()
+	return nil
+}
+
+func newTicketKey() ([32]byte, error) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	return key, err
+}
@@ -0,0 +1,16 @@
+package main
+
+import "encoding/hex"
+
+// traceFrame logs a hexdump of up to config.traceBytes of a proxied frame
+// when -trace is enabled.
+func traceFrame(sessionID, direction string, p []byte) {
+	if !config.trace {
+		return
+	}
+	n := len(p)
+	if n > config.traceBytes {
+		n = config.traceBytes
+	}
+	verboseLogger.Printf("Session %s %s %d bytes:\n%s", sessionID, direction, len(p), hex.Dump(p[:n]))
+}
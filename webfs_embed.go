@@ -0,0 +1,20 @@
+//go:build embedweb
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// embeddedWebFiles holds the web directory next to the sources, typically a
+// noVNC checkout, when built with -tags embedweb. The all: prefix also
+// embeds files whose names start with . or _, which the web UI may need.
+//
+//go:embed all:web
+var embeddedWebFiles embed.FS
+
+// embeddedWeb returns the files built into the binary for -embedded-web.
+func embeddedWeb() (fs.FS, error) {
+	return fs.Sub(embeddedWebFiles, "web")
+}
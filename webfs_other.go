@@ -0,0 +1,12 @@
+//go:build !embedweb
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+)
+
+func embeddedWeb() (fs.FS, error) {
+	return nil, errors.New("this binary has no embedded web files; build it with -tags embedweb")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn is a *websocket.Conn whose data writes are serialized, since Gorilla
+// allows only one concurrent writer of messages and several goroutines may
+// write to the same connection. WriteControl is left to Gorilla, which allows
+// it concurrently with everything else and bounds it by its own deadline, so
+// keepalive pings and closes aren't stuck behind a write to a client that
+// stopped reading. Reads stay unguarded; each connection has a single reader.
+type wsConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+
+	// closeOnce makes Close idempotent: the proxy loops, keepalive, shutdown
+	// and the admin API may all close the connection at once.
+	closeOnce sync.Once
+	closeErr  error
+
+	// lastActivity is the UnixNano time data last flowed either way.
+	// Control frames don't count, and with -idle-ignores-control neither
+	// do text messages from the client.
+	lastActivity atomic.Int64
+
+	// maxFrame, if not zero, splits written messages into frames of at
+	// most this many bytes; see writeFragmented.
+	maxFrame int
+
+	// readTimeout, if not zero, bounds each message read, waiting for it
+	// included; readDue is when the current one must be done by, as
+	// UnixNano, or 0.
+	readTimeout time.Duration
+	readDue     atomic.Int64
+}
+
+func newWSConn(conn *websocket.Conn) *wsConn {
+	c := &wsConn{Conn: conn}
+	c.touch()
+	return c
+}
+
+func (c *wsConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idle returns how long no data has flowed over the connection.
+func (c *wsConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastActivity.Load()))
+}
+
+// armReadDeadline starts the readTimeout of the next message read.
+func (c *wsConn) armReadDeadline() {
+	if c.readTimeout <= 0 {
+		return
+	}
+	due := time.Now().Add(c.readTimeout)
+	c.readDue.Store(due.UnixNano())
+	c.SetReadDeadline(due)
+}
+
+// readDeadline returns the deadline readTimeout set on the current read, or
+// the zero time if there is none.
+func (c *wsConn) readDeadline() time.Time {
+	if due := c.readDue.Load(); due != 0 {
+		return time.Unix(0, due)
+	}
+	return time.Time{}
+}
+
+func (c *wsConn) NextReader() (int, io.Reader, error) {
+	c.armReadDeadline()
+	messageType, r, err := c.Conn.NextReader()
+	if err == nil && countsAsActivity(messageType) {
+		c.touch()
+	}
+	return messageType, r, err
+}
+
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	c.armReadDeadline()
+	messageType, p, err := c.Conn.ReadMessage()
+	if err == nil && countsAsActivity(messageType) {
+		c.touch()
+	}
+	return messageType, p, err
+}
+
+// WriteMessage writes one message. A failed write is not retried, timeouts
+// included: Gorilla latches the first write error and returns it from every
+// later write, because a partly sent frame can't be resumed, so the session
+// has to end.
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.touch()
+	if c.maxFrame > 0 && len(data) > c.maxFrame {
+		return c.writeFragmented(messageType, data)
+	}
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// writeFragmented writes data as one message in frames of at most maxFrame
+// bytes. Gorilla's WriteMessage sends a server message as a single frame,
+// but a NextWriter message is cut into a frame each time the write buffer
+// fills. With the write buffer sized to maxFrame and data written in
+// chunks no larger, every frame but the last holds exactly maxFrame bytes.
+func (c *wsConn) writeFragmented(messageType int, data []byte) error {
+	w, err := c.Conn.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := min(len(data), c.maxFrame)
+		if _, err := w.Write(data[:n]); err != nil {
+			w.Close()
+			return err
+		}
+		data = data[n:]
+	}
+	return w.Close()
+}
+
+// Close closes the connection the first time it is called and returns the
+// same result from every call.
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { c.closeErr = c.Conn.Close() })
+	return c.closeErr
+}
+
+// countsAsActivity reports whether receiving a message of messageType
+// resets the idle time.
+func countsAsActivity(messageType int) bool {
+	return messageType == websocket.BinaryMessage || !config.idleIgnoresCtrl
+}
+
+// sharesSubprotocol reports whether the client offered any of the
+// subprotocols the server supports.
+func sharesSubprotocol(supported, offered []string) bool {
+	for _, p := range offered {
+		if slices.Contains(supported, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair returns the server side of a WebSocket connection, wrapped the way
+// proxy wraps it, and the client side.
+func wsPair(t testing.TB) (*wsConn, *websocket.Conn) {
+	t.Helper()
+	server := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		server <- c
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn := newWSConn(<-server)
+	t.Cleanup(func() { conn.Close() })
+	return conn, client
+}
+
+// TestWSConnConcurrentWriters writes from several goroutines at once, as the
+// proxy loop, keepalive pings and a shutdown close do. Run with -race;
+// Gorilla also panics on concurrent writes, and interleaved frames would
+// corrupt the messages the client reads.
+func TestWSConnConcurrentWriters(t *testing.T) {
+	conn, client := wsPair(t)
+	const writers, messages = 4, 200
+
+	pings := 0
+	var pingMu sync.Mutex
+	client.SetPingHandler(func(string) error {
+		pingMu.Lock()
+		pings++
+		pingMu.Unlock()
+		return nil
+	})
+	received := make(chan error, 1)
+	counts := make(map[byte]int)
+	go func() {
+		for {
+			_, msg, err := client.ReadMessage()
+			if err != nil {
+				received <- err
+				return
+			}
+			// Each message is one writer's ID repeated
+			if len(msg) == 0 || !bytes.Equal(msg, bytes.Repeat(msg[:1], len(msg))) {
+				received <- errors.New("message mixes several writers' bytes")
+				return
+			}
+			counts[msg[0]]++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := bytes.Repeat([]byte{byte('a' + w)}, 4096)
+			for range messages {
+				if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+					t.Errorf("WriteMessage: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range messages {
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				t.Errorf("WriteControl ping: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Shutdown closes while the loops may still be writing
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(time.Second))
+	}()
+	go func() {
+		defer wg.Done()
+		conn.WriteMessage(websocket.BinaryMessage, []byte("zzzz"))
+	}()
+	wg.Wait()
+
+	err := <-received
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("client read ended with %v, want a 1001 close", err)
+	}
+	for w := range writers {
+		if n := counts[byte('a'+w)]; n != messages {
+			t.Errorf("client got %d messages from writer %d, want %d", n, w, messages)
+		}
+	}
+	pingMu.Lock()
+	defer pingMu.Unlock()
+	if pings != messages {
+		t.Errorf("client got %d pings, want %d", pings, messages)
+	}
+}
+
+// TestWSConnControlNotBlockedByWriter blocks a data write on a client that
+// stopped reading and checks that a control write still returns by its
+// deadline, as keepalive's idle close and session.terminate rely on.
+func TestWSConnControlNotBlockedByWriter(t *testing.T) {
+	conn, _ := wsPair(t)
+
+	// The client never reads, so the socket buffers fill and a write blocks
+	go func() {
+		msg := make([]byte, 1<<20)
+		for conn.WriteMessage(websocket.BinaryMessage, msg) == nil {
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(100*time.Millisecond))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteControl blocked behind a stuck WriteMessage")
+	}
+}
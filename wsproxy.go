@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebSocketTarget connects to the -target-ws backend for r. With
+// -target-ws-subprotocols it offers the backend the subprotocols the client
+// offered. It also returns the -relay-response-headers of the backend's
+// handshake response. Failed attempts are counted under routeName.
+func dialWebSocketTarget(r *http.Request, routeName string) (*wsConn, http.Header, error) {
+	header := config.targetWSHeader.Clone()
+	for _, name := range config.targetWSForward {
+		if v := r.Header.Values(name); len(v) > 0 {
+			header[name] = v
+		}
+	}
+	dialer := *websocket.DefaultDialer
+	if config.targetWSProtos {
+		dialer.Subprotocols = websocket.Subprotocols(r)
+	}
+	if config.dscp != 0 {
+		dialer.NetDialContext = (&net.Dialer{Control: controlDialer}).DialContext
+	}
+	ctx, cancel := withConnectBudget(r.Context())
+	defer cancel()
+	b, resp, err := dialer.DialContext(ctx, config.targetWS, header)
+	if err != nil {
+		metrics.dialFailed(routeName)
+		if errors.Is(context.Cause(ctx), errConnectBudget) {
+			return nil, nil, fmt.Errorf("%w after %v", errConnectBudget, config.connectBudget)
+		}
+		return nil, nil, err
+	}
+	return newWSConn(b), relayedHeaders(resp.Header), nil
+}
+
+// relayedHeaders returns the -relay-response-headers present in h, or nil
+// if there are none.
+func relayedHeaders(h http.Header) http.Header {
+	var relayed http.Header
+	for _, name := range config.relayRespHeaders {
+		if v := h.Values(name); len(v) > 0 {
+			if relayed == nil {
+				relayed = make(http.Header)
+			}
+			relayed[name] = v
+		}
+	}
+	return relayed
+}
+
+// parseRelayHeaders parses the comma-separated -relay-response-headers list.
+func parseRelayHeaders(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid -relay-response-headers name %q", name)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		switch name {
+		case "Upgrade", "Connection", "Content-Length", "Transfer-Encoding", "Sec-Websocket-Accept", "Sec-Websocket-Protocol", "Sec-Websocket-Extensions":
+			return nil, fmt.Errorf("invalid -relay-response-headers name %q: it belongs to the backend's own handshake", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// proxyWebSocket pipes messages frame for frame between the client and the
+// -target-ws backend, preserving message types and close codes. backend is
+// dialed here unless proxy already did so to negotiate the subprotocol.
+func proxyWebSocket(conn *wsConn, r *http.Request, sess *session, rec *recorder, backend *wsConn) {
+	if backend == nil {
+		var err error
+		if backend, _, err = dialWebSocketTarget(r, sess.route); err != nil {
+			logger.Printf("Error connecting to WebSocket target %s: %v", redactURL(config.targetWS), err)
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, dialFailureReason(err)),
+				time.Now().Add(time.Second))
+			return
+		}
+	}
+	defer backend.Close()
+	verboseLogger.Printf("Session %s connected to WebSocket target %s", sess.id, redactURL(config.targetWS))
+	sess.setTarget(redactURL(config.targetWS))
+	defer trackSession(sess)()
+
+	errc := make(chan error, 2)
+	go func() { errc <- pipeMessages(conn, backend, sess, toClient, rec) }()
+	go func() { errc <- pipeMessages(backend, conn, sess, toTarget, rec) }()
+	if err := <-errc; err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		logger.Printf("Session %s: WebSocket proxy error: %v", sess.id, err)
+	}
+}
+
+// defaultUserAgent identifies the proxy to WebSocket backends unless
+// -target-ws-header overrides it.
+const defaultUserAgent = "websockify-go"
+
+// parseTargetWSHeaders parses -target-ws-header values. "Name: Value" adds a
+// fixed header; a bare "Name" forwards that header from the client request.
+func parseTargetWSHeaders(values []string) (http.Header, []string, error) {
+	header := http.Header{"User-Agent": {defaultUserAgent}}
+	overridden := make(map[string]bool)
+	var forward []string
+	for _, v := range values {
+		name, value, hasValue := strings.Cut(v, ":")
+		name = strings.TrimSpace(name)
+		if !validHeaderName(name) {
+			return nil, nil, fmt.Errorf("invalid -target-ws-header %q: bad header name", v)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		switch name {
+		case "Host", "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions":
+			return nil, nil, fmt.Errorf("invalid -target-ws-header %q: %s is set by the WebSocket handshake", v, name)
+		}
+		if !hasValue {
+			forward = append(forward, name)
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, nil, fmt.Errorf("invalid -target-ws-header %q: bad header value", v)
+		}
+		if !overridden[name] {
+			header.Del(name)
+			overridden[name] = true
+		}
+		header.Add(name, value)
+	}
+	return header, forward, nil
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// pipeMessages copies messages from src to dst until reading src fails. A
+// close frame received from src is passed on to dst with the same code and
+// reason.
+func pipeMessages(dst, src *wsConn, sess *session, direction string, rec *recorder) error {
+	for {
+		msgType, msg, err := src.ReadMessage()
+		if err != nil {
+			if direction == toClient {
+				sess.setCloseCause(causeBackend)
+			} else {
+				sess.setCloseCause(readCause(err))
+			}
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) && ce.Code != websocket.CloseAbnormalClosure {
+				dst.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(ce.Code, ce.Text),
+					time.Now().Add(time.Second))
+			}
+			return err
+		}
+		throttleTotal(len(msg))
+		traceFrame(sess.id, direction, msg)
+		rec.write(direction, msg)
+		sess.count(direction, len(msg))
+		if err := dst.WriteMessage(msgType, msg); err != nil {
+			sess.setCloseCause(causeError)
+			return err
+		}
+	}
+}